@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dev.hon.one/prometheus-ethermine-exporter/util"
+	"gopkg.in/yaml.v3"
+)
+
+// Config file structure.
+// The options which correspond to command line arguments are pointers and nil if not set,
+// and the sections and keys mirror the argument names.
+type config struct {
+	Server     serverConfig          `yaml:"server"`
+	HTTP       httpConfig            `yaml:"http"`
+	Pool       poolConfig            `yaml:"pool"`
+	Miner      minerConfig           `yaml:"miner"`
+	Poller     pollerConfig          `yaml:"poller"`
+	RateLimit  rateLimitConfig       `yaml:"ratelimit"`
+	Circuit    circuitConfig         `yaml:"circuit"`
+	Stale      staleConfig           `yaml:"stale"`
+	SD         sdConfig              `yaml:"sd"`
+	Currencies []currencyEntryConfig `yaml:"currencies"`
+	Pools      []poolEntryConfig     `yaml:"pools"`
+	Miners     []minerEntryConfig    `yaml:"miners"`
+}
+
+type serverConfig struct {
+	Endpoint *string `yaml:"endpoint"`
+	Debug    *bool   `yaml:"debug"`
+}
+
+type httpConfig struct {
+	ConnectTimeout      *time.Duration `yaml:"connect_timeout"`
+	Timeout             *time.Duration `yaml:"timeout"`
+	Retries             *int           `yaml:"retries"`
+	BackoffInitial      *time.Duration `yaml:"backoff_initial"`
+	BackoffMax          *time.Duration `yaml:"backoff_max"`
+	ScrapeTimeoutOffset *time.Duration `yaml:"scrape_timeout_offset"`
+	ProxyURL            *string        `yaml:"proxy_url"`
+	CAFile              *string        `yaml:"ca_file"`
+	CertFile            *string        `yaml:"cert_file"`
+	KeyFile             *string        `yaml:"key_file"`
+	TLSMinVersion       *string        `yaml:"tls_min_version"`
+}
+
+type poolConfig struct {
+	TopMinersMaxRank *int `yaml:"top_miners_max_rank"`
+}
+
+type minerConfig struct {
+	Dashboard      *bool `yaml:"dashboard"`
+	MaxConcurrency *int  `yaml:"max_concurrency"`
+}
+
+type pollerConfig struct {
+	Interval *time.Duration `yaml:"interval"`
+	Expiry   *time.Duration `yaml:"expiry"`
+}
+
+type rateLimitConfig struct {
+	MaxWait *time.Duration `yaml:"max_wait"`
+}
+
+type circuitConfig struct {
+	FailureThreshold *int           `yaml:"failure_threshold"`
+	OpenDuration     *time.Duration `yaml:"open_duration"`
+}
+
+type staleConfig struct {
+	MaxAge *time.Duration `yaml:"max_age"`
+}
+
+type sdConfig struct {
+	TargetAddress *string `yaml:"target_address"`
+}
+
+// Additional currency, or override for one of the supported currencies.
+type currencyEntryConfig struct {
+	Symbol           string  `yaml:"symbol"`
+	BaseUnitsPerUnit float64 `yaml:"base_units_per_unit"`
+}
+
+// Additional pool, or settings for one of the supported pools.
+// The currency and API URL are required for additional pools.
+type poolEntryConfig struct {
+	ID                 string   `yaml:"id"`
+	Name               string   `yaml:"name"`
+	Currency           string   `yaml:"currency"`
+	APIURL             string   `yaml:"api_url"`
+	RateLimitPerMinute *float64 `yaml:"rate_limit_per_minute"`
+	RateLimitBurst     *int     `yaml:"rate_limit_burst"`
+	// Optional data to scrape, for the /metrics endpoint.
+	ServerHistory bool `yaml:"server_history"`
+	Network       bool `yaml:"network"`
+	Blocks        bool `yaml:"blocks"`
+}
+
+func (poolEntry *poolEntryConfig) options() poolOptions {
+	return poolOptions{
+		serverHistory: poolEntry.ServerHistory,
+		network:       poolEntry.Network,
+		blocks:        poolEntry.Blocks,
+	}
+}
+
+// Miner to monitor.
+type minerEntryConfig struct {
+	Pool    string `yaml:"pool"`
+	Address string `yaml:"address"`
+	// Optional, unique if set.
+	Alias string `yaml:"alias"`
+	// Optional, for scraping multiple miners together.
+	Groups []string `yaml:"groups"`
+	// Optional data to scrape, for the /metrics and /sd endpoints.
+	Payouts       bool `yaml:"payouts"`
+	Rounds        bool `yaml:"rounds"`
+	Settings      bool `yaml:"settings"`
+	WorkerHistory bool `yaml:"worker_history"`
+}
+
+func (minerEntry *minerEntryConfig) options() minerOptions {
+	return minerOptions{
+		payouts:       minerEntry.Payouts,
+		rounds:        minerEntry.Rounds,
+		settings:      minerEntry.Settings,
+		workerHistory: minerEntry.WorkerHistory,
+	}
+}
+
+func (minerEntry *minerEntryConfig) hasGroup(groupName string) bool {
+	for _, entryGroupName := range minerEntry.Groups {
+		if entryGroupName == groupName {
+			return true
+		}
+	}
+	return false
+}
+
+// Pools, currencies, miners and HTTP client from the config, which are replaced as a whole when reloading the config.
+// Must not be modified.
+type activeConfig struct {
+	pools      map[string]Pool
+	currencies map[CurrencySymbol]Currency
+	miners     []minerEntryConfig
+	httpClient *util.HTTPClient
+	// Rate limits for the API hosts of the pools.
+	hostRateLimits map[string]hostRateLimit
+	// Pools in the config file or with miners in the config file, for the /metrics endpoint.
+	staticPoolIDs []string
+	// Options for the pools in the config file, for the /metrics endpoint.
+	staticPoolOptions map[string]poolOptions
+}
+
+var activeConfigValue atomic.Value
+
+// Arguments set explicitly on the command line or as environment variables, which take precedence over the config file.
+var explicitArgs map[string]bool
+
+// Serializes reloads.
+var reloadMutex sync.Mutex
+
+var configReloadSuccessMetric = util.NewGauge(exporterRegistry, namespace, "config", "last_reload_successful", "Whether the last config reload attempt was successful.", nil)
+var configReloadTimestampMetric = util.NewGauge(exporterRegistry, namespace, "config", "last_reload_success_timestamp_seconds", "Timestamp of the last successful config reload.", nil)
+
+// Get the options which correspond to command line arguments, by argument name. The values are pointers.
+func (cfg *config) argOptions() map[string]interface{} {
+	return map[string]interface{}{
+		"endpoint":                   cfg.Server.Endpoint,
+		"debug":                      cfg.Server.Debug,
+		"http.connect-timeout":       cfg.HTTP.ConnectTimeout,
+		"http.timeout":               cfg.HTTP.Timeout,
+		"http.retries":               cfg.HTTP.Retries,
+		"http.backoff-initial":       cfg.HTTP.BackoffInitial,
+		"http.backoff-max":           cfg.HTTP.BackoffMax,
+		"http.scrape-timeout-offset": cfg.HTTP.ScrapeTimeoutOffset,
+		"http.proxy-url":             cfg.HTTP.ProxyURL,
+		"http.ca-file":               cfg.HTTP.CAFile,
+		"http.cert-file":             cfg.HTTP.CertFile,
+		"http.key-file":              cfg.HTTP.KeyFile,
+		"http.tls-min-version":       cfg.HTTP.TLSMinVersion,
+		"pool.top-miners-max-rank":   cfg.Pool.TopMinersMaxRank,
+		"miner.dashboard":            cfg.Miner.Dashboard,
+		"miner.max-concurrency":      cfg.Miner.MaxConcurrency,
+		"poller.interval":            cfg.Poller.Interval,
+		"poller.expiry":              cfg.Poller.Expiry,
+		"ratelimit.max-wait":         cfg.RateLimit.MaxWait,
+		"circuit.failure-threshold":  cfg.Circuit.FailureThreshold,
+		"circuit.open-duration":      cfg.Circuit.OpenDuration,
+		"stale.max-age":              cfg.Stale.MaxAge,
+		"sd.target-address":          cfg.SD.TargetAddress,
+	}
+}
+
+// Parse and validate the config file.
+func parseConfigFile(path string) (*config, error) {
+	rawData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	var cfg config
+	decoder := yaml.NewDecoder(bytes.NewReader(rawData))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if _, _, err := cfg.buildPools(); err != nil {
+		return nil, fmt.Errorf("invalid config file: %w", err)
+	}
+	if err := cfg.validateMiners(); err != nil {
+		return nil, fmt.Errorf("invalid config file: %w", err)
+	}
+	return &cfg, nil
+}
+
+// Build the pool and currency lists from the supported ones and the ones in the config file.
+func (cfg *config) buildPools() (map[string]Pool, map[CurrencySymbol]Currency, error) {
+	currencies := make(map[CurrencySymbol]Currency, len(Currencies)+len(cfg.Currencies))
+	for symbol, currency := range Currencies {
+		currencies[symbol] = currency
+	}
+	currencySymbols := make(map[string]bool)
+	for i, currencyEntry := range cfg.Currencies {
+		if currencyEntry.Symbol == "" {
+			return nil, nil, fmt.Errorf("currencies[%d]: missing symbol", i)
+		}
+		if currencySymbols[currencyEntry.Symbol] {
+			return nil, nil, fmt.Errorf("currencies[%d]: duplicate currency: %s", i, currencyEntry.Symbol)
+		}
+		currencySymbols[currencyEntry.Symbol] = true
+		if currencyEntry.BaseUnitsPerUnit <= 0 {
+			return nil, nil, fmt.Errorf("currencies[%d]: base_units_per_unit must be positive", i)
+		}
+		symbol := CurrencySymbol(currencyEntry.Symbol)
+		currencies[symbol] = Currency{symbol, currencyEntry.BaseUnitsPerUnit}
+	}
+
+	pools := make(map[string]Pool, len(Pools)+len(cfg.Pools))
+	for poolID, pool := range Pools {
+		pools[poolID] = pool
+	}
+	poolIDs := make(map[string]bool)
+	for i, poolEntry := range cfg.Pools {
+		if poolEntry.ID == "" {
+			return nil, nil, fmt.Errorf("pools[%d]: missing id", i)
+		}
+		if poolIDs[poolEntry.ID] {
+			return nil, nil, fmt.Errorf("pools[%d]: duplicate pool: %s", i, poolEntry.ID)
+		}
+		poolIDs[poolEntry.ID] = true
+		pool, exists := pools[poolEntry.ID]
+		if !exists {
+			if poolEntry.Currency == "" {
+				return nil, nil, fmt.Errorf("pools[%d]: missing currency for new pool: %s", i, poolEntry.ID)
+			}
+			if poolEntry.APIURL == "" {
+				return nil, nil, fmt.Errorf("pools[%d]: missing api_url for new pool: %s", i, poolEntry.ID)
+			}
+			pool = Pool{poolEntry.ID, poolEntry.ID, "", "", defaultPoolRateLimitPerMinute, defaultPoolRateLimitBurst}
+		}
+		if poolEntry.Name != "" {
+			pool.Name = poolEntry.Name
+		}
+		if poolEntry.Currency != "" {
+			if _, ok := currencies[CurrencySymbol(poolEntry.Currency)]; !ok {
+				return nil, nil, fmt.Errorf("pools[%d]: unknown currency: %s", i, poolEntry.Currency)
+			}
+			pool.Currency = CurrencySymbol(poolEntry.Currency)
+		}
+		if poolEntry.APIURL != "" {
+			apiURL, err := url.Parse(poolEntry.APIURL)
+			if err != nil || (apiURL.Scheme != "http" && apiURL.Scheme != "https") || apiURL.Host == "" {
+				return nil, nil, fmt.Errorf("pools[%d]: invalid api_url: %s", i, poolEntry.APIURL)
+			}
+			pool.APIURL = strings.TrimSuffix(poolEntry.APIURL, "/")
+		}
+		if poolEntry.RateLimitPerMinute != nil {
+			if *poolEntry.RateLimitPerMinute <= 0 {
+				return nil, nil, fmt.Errorf("pools[%d]: rate_limit_per_minute must be positive", i)
+			}
+			pool.RateLimitPerMinute = *poolEntry.RateLimitPerMinute
+		}
+		if poolEntry.RateLimitBurst != nil {
+			if *poolEntry.RateLimitBurst < 1 {
+				return nil, nil, fmt.Errorf("pools[%d]: rate_limit_burst must be at least 1", i)
+			}
+			pool.RateLimitBurst = *poolEntry.RateLimitBurst
+		}
+		pools[poolEntry.ID] = pool
+	}
+	return pools, currencies, nil
+}
+
+func (cfg *config) validateMiners() error {
+	poolIDs := make(map[string]bool)
+	for poolID := range Pools {
+		poolIDs[poolID] = true
+	}
+	for _, poolEntry := range cfg.Pools {
+		poolIDs[poolEntry.ID] = true
+	}
+	minerKeys := make(map[string]bool)
+	aliases := make(map[string]bool)
+	for i, minerEntry := range cfg.Miners {
+		if minerEntry.Pool == "" {
+			return fmt.Errorf("miners[%d]: missing pool", i)
+		}
+		if !poolIDs[minerEntry.Pool] {
+			return fmt.Errorf("miners[%d]: unknown pool: %s", i, minerEntry.Pool)
+		}
+		if minerEntry.Address == "" {
+			return fmt.Errorf("miners[%d]: missing address", i)
+		}
+		minerKey := minerEntry.Pool + "/" + minerEntry.Address
+		if minerKeys[minerKey] {
+			return fmt.Errorf("miners[%d]: duplicate miner: %s", i, minerKey)
+		}
+		minerKeys[minerKey] = true
+		if minerEntry.Alias != "" {
+			if aliases[minerEntry.Alias] {
+				return fmt.Errorf("miners[%d]: duplicate alias: %s", i, minerEntry.Alias)
+			}
+			aliases[minerEntry.Alias] = true
+		}
+		for _, groupName := range minerEntry.Groups {
+			if groupName == "" {
+				return fmt.Errorf("miners[%d]: empty group name", i)
+			}
+		}
+	}
+	return nil
+}
+
+// Load the config file (if any) and apply it. Arguments set explicitly take precedence over the config file.
+// Logs the resulting effective config.
+func loadConfig() error {
+	explicitArgs = getExplicitArgs()
+
+	cfg := &config{}
+	if configFile != "" {
+		var err error
+		if cfg, err = parseConfigFile(configFile); err != nil {
+			return err
+		}
+	}
+	if err := setArgsFromConfig(flag.CommandLine, cfg); err != nil {
+		return err
+	}
+	if err := activateConfig(cfg, httpClientOptions); err != nil {
+		return err
+	}
+	logEffectiveConfig(cfg)
+	return nil
+}
+
+// Log the value of every argument with where it was set, plus the number of pools and miners.
+func logEffectiveConfig(cfg *config) {
+	argOptions := cfg.argOptions()
+	fmt.Printf("Effective config:\n")
+	flag.VisitAll(func(f *flag.Flag) {
+		source := "default"
+		if argSources[f.Name] != "" {
+			source = argSources[f.Name]
+		} else if option, ok := argOptions[f.Name]; ok && !reflect.ValueOf(option).IsNil() {
+			source = "config file"
+		}
+		value := f.Value.String()
+		if f.Name == "http.proxy-url" && value != "" {
+			// Hide proxy password
+			if proxyURL, err := url.Parse(value); err == nil {
+				value = proxyURL.Redacted()
+			}
+		}
+		fmt.Printf("- %s=%q (%s)\n", f.Name, value, source)
+	})
+	activeConfig := getActiveConfig()
+	fmt.Printf("- %d pools, %d currencies, %d miners\n", len(activeConfig.pools), len(activeConfig.currencies), len(activeConfig.miners))
+}
+
+// Reload the config file, atomically swapping the pools, currencies, miners and HTTP client.
+// Other options require a restart. The active config is kept if the new config is invalid.
+func reloadConfig() error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	err := reloadConfigUnlocked()
+	if err != nil {
+		configReloadSuccessMetric.Set(0)
+		return err
+	}
+	configReloadSuccessMetric.Set(1)
+	configReloadTimestampMetric.SetToCurrentTime()
+	return nil
+}
+
+func reloadConfigUnlocked() error {
+	cfg := &config{}
+	if configFile != "" {
+		var err error
+		if cfg, err = parseConfigFile(configFile); err != nil {
+			return err
+		}
+	}
+
+	// Resolve the HTTP client arguments into a separate flag set, to avoid modifying the active options
+	options := util.HTTPClientOptions{}
+	flagSet := flag.NewFlagSet("http", flag.ContinueOnError)
+	registerHTTPClientFlags(flagSet, &options)
+	if err := setArgsFromConfig(flagSet, cfg); err != nil {
+		return err
+	}
+	return activateConfig(cfg, options)
+}
+
+// Get the arguments set explicitly on the command line or as environment variables.
+func getExplicitArgs() map[string]bool {
+	args := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		args[f.Name] = true
+	})
+	return args
+}
+
+// Set the arguments in the flag set from the explicitly set arguments or the config file options, in that order.
+// Arguments not set in either are left at their current value.
+func setArgsFromConfig(flagSet *flag.FlagSet, cfg *config) error {
+	argOptions := cfg.argOptions()
+	var argNames []string
+	flagSet.VisitAll(func(f *flag.Flag) {
+		argNames = append(argNames, f.Name)
+	})
+	for _, argName := range argNames {
+		var value string
+		if explicitArgs[argName] {
+			value = flag.Lookup(argName).Value.String()
+		} else if option, ok := argOptions[argName]; ok && !reflect.ValueOf(option).IsNil() {
+			value = fmt.Sprint(reflect.ValueOf(option).Elem().Interface())
+		} else {
+			continue
+		}
+		if err := flagSet.Lookup(argName).Value.Set(value); err != nil {
+			return fmt.Errorf("invalid value for argument %s: %w", argName, err)
+		}
+	}
+	return nil
+}
+
+// Build the pools, currencies and HTTP client for the (validated) config and make them active.
+func activateConfig(cfg *config, options util.HTTPClientOptions) error {
+	pools, currencies, err := cfg.buildPools()
+	if err != nil {
+		return err
+	}
+	client, err := util.NewHTTPClient(options)
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP client: %w", err)
+	}
+	hostRateLimits := getHostRateLimits(pools)
+	var staticPoolIDs []string
+	staticPoolOptions := make(map[string]poolOptions)
+	staticPoolIDsSet := make(map[string]bool)
+	for _, poolEntry := range cfg.Pools {
+		staticPoolIDs = append(staticPoolIDs, poolEntry.ID)
+		staticPoolIDsSet[poolEntry.ID] = true
+		staticPoolOptions[poolEntry.ID] = poolEntry.options()
+	}
+	for _, minerEntry := range cfg.Miners {
+		if !staticPoolIDsSet[minerEntry.Pool] {
+			staticPoolIDs = append(staticPoolIDs, minerEntry.Pool)
+			staticPoolIDsSet[minerEntry.Pool] = true
+		}
+	}
+	activeConfigValue.Store(&activeConfig{
+		pools:             pools,
+		currencies:        currencies,
+		miners:            cfg.Miners,
+		httpClient:        client,
+		hostRateLimits:    hostRateLimits,
+		staticPoolIDs:     staticPoolIDs,
+		staticPoolOptions: staticPoolOptions,
+	})
+	updateRateLimiters(hostRateLimits)
+	return nil
+}
+
+// Get the active pools, currencies, miners and HTTP client.
+func getActiveConfig() *activeConfig {
+	return activeConfigValue.Load().(*activeConfig)
+}
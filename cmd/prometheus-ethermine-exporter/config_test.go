@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"testing"
+	"time"
+
+	"dev.hon.one/prometheus-ethermine-exporter/util"
+)
+
+func TestArgPrecedence(t *testing.T) {
+	envName := getArgEnvName("http.timeout")
+	configTimeout := 3 * time.Second
+	tests := []struct {
+		name       string
+		args       []string
+		env        string
+		config     *time.Duration
+		wantValue  time.Duration
+		wantSource string
+	}{
+		{"default", nil, "", nil, defaultHTTPTimeout, ""},
+		{"config", nil, "", &configTimeout, configTimeout, ""},
+		{"env over config", nil, "2s", &configTimeout, 2 * time.Second, "environment"},
+		{"argument over env and config", []string{"--http.timeout=1s"}, "2s", &configTimeout, time.Second, "argument"},
+		{"argument over config", []string{"--http.timeout=1s"}, "", &configTimeout, time.Second, "argument"},
+	}
+	defer func(commandLine *flag.FlagSet) {
+		flag.CommandLine = commandLine
+	}(flag.CommandLine)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+			var options util.HTTPClientOptions
+			registerHTTPClientFlags(flag.CommandLine, &options)
+			if err := flag.CommandLine.Parse(test.args); err != nil {
+				t.Fatal(err)
+			}
+			if test.env != "" {
+				os.Setenv(envName, test.env)
+				defer os.Unsetenv(envName)
+			}
+			if err := setArgsFromEnv(); err != nil {
+				t.Fatal(err)
+			}
+			explicitArgs = getExplicitArgs()
+			cfg := &config{HTTP: httpConfig{Timeout: test.config}}
+
+			// On startup
+			if err := setArgsFromConfig(flag.CommandLine, cfg); err != nil {
+				t.Fatal(err)
+			}
+			if options.Timeout != test.wantValue {
+				t.Errorf("got %v, want %v", options.Timeout, test.wantValue)
+			}
+			if argSources["http.timeout"] != test.wantSource {
+				t.Errorf("got source %q, want %q", argSources["http.timeout"], test.wantSource)
+			}
+
+			// On reload, into a separate flag set
+			var reloadOptions util.HTTPClientOptions
+			reloadFlagSet := flag.NewFlagSet("reload", flag.ContinueOnError)
+			registerHTTPClientFlags(reloadFlagSet, &reloadOptions)
+			if err := setArgsFromConfig(reloadFlagSet, cfg); err != nil {
+				t.Fatal(err)
+			}
+			if reloadOptions.Timeout != test.wantValue {
+				t.Errorf("got %v on reload, want %v", reloadOptions.Timeout, test.wantValue)
+			}
+		})
+	}
+}
+
+func TestArgFromEnvInvalid(t *testing.T) {
+	defer func(commandLine *flag.FlagSet) {
+		flag.CommandLine = commandLine
+	}(flag.CommandLine)
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	var options util.HTTPClientOptions
+	registerHTTPClientFlags(flag.CommandLine, &options)
+	envName := getArgEnvName("http.retries")
+	os.Setenv(envName, "many")
+	defer os.Unsetenv(envName)
+	if err := setArgsFromEnv(); err == nil {
+		t.Errorf("got no error for invalid value %q", "many")
+	}
+}
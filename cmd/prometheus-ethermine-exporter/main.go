@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"dev.hon.one/prometheus-ethermine-exporter/util"
 	"github.com/prometheus/client_golang/prometheus"
@@ -47,111 +55,105 @@ type Pool struct {
 	Currency CurrencySymbol
 	// URL must not have a trailing slash.
 	APIURL string
+	// Max average rate of requests to the API. Pools sharing the same API host share the rate limit.
+	RateLimitPerMinute float64
+	// Max number of requests to the API in a burst.
+	RateLimitBurst int
 }
 
+// Conservative default API rate limits for the supported pools.
+const defaultPoolRateLimitPerMinute = 100.0 / 15
+const defaultPoolRateLimitBurst = 10
+
 // Pools - List of supported pools.
 var Pools = map[string]Pool{
-	"ethermine":         {"ethermine", "Ethermine", CurrencySymbolEthereum, "https://api.ethermine.org"},
-	"ethermine-etc":     {"ethermine-etc", "ETC Ethermine", CurrencySymbolEthereumClassic, "https://api-etc.ethermine.org"},
-	"ethpool":           {"ethpool", "Ethpool", CurrencySymbolEthereum, "https://api.ethpool.org"},
-	"flypool-zcash":     {"flypool-zcash", "Zcash Flypool", CurrencySymbolZcash, "https://api-zcash.flypool.org"},
-	"flypool-ravencoin": {"flypool-ravencoin", "Ravencoin Flypool", CurrencySymbolRavencoin, "https://api-ravencoin.flypool.org"},
-	"flypool-beam":      {"flypool-beam", "Flypool BEAM", CurrencySymbolBEAM, "https://api-beam.flypool.org"},
-}
-
-type baseAPIData struct {
-	Status string `json:"status"`
-}
-
-type noDataAPIData struct {
-	baseAPIData
-	Data string `json:"data"`
-}
-
-type poolBasicAPIData struct {
-	baseAPIData
-	Data struct {
-		Stats struct {
-			HashRate    float64 `json:"hashRate"`
-			MinerCount  float64 `json:"miners"`
-			WorkerCount float64 `json:"workers"`
-		} `json:"poolStats"`
-		Price struct {
-			USD float64 `json:"usd"`
-			BTC float64 `json:"btc"`
-		} `json:"price"`
-	} `json:"data"`
-}
-
-type poolServerAPIData struct {
-	baseAPIData
-	Data []poolServerAPIDataElement `json:"data"`
-}
-
-type poolServerAPIDataElement struct {
-	Time     int64   `json:"time"`
-	HashRate float64 `json:"hashrate"`
-	Server   string  `json:"server"`
-}
-
-type minerStatsAPIData struct {
-	baseAPIData
-	Data struct {
-		Timestamp                   float64 `json:"time"`
-		LastSeenTimestamp           float64 `json:"lastSeen"`
-		ReportedHashRate            float64 `json:"reportedHashrate"`
-		CurrentHashRate             float64 `json:"currentHashrate"`
-		AverageHashRate             float64 `json:"averageHashrate"`
-		ValidShares                 float64 `json:"validShares"`
-		InvalidShares               float64 `json:"invalidShares"`
-		StaleShares                 float64 `json:"staleShares"`
-		ActiveWorkers               float64 `json:"activeWorkers"`
-		UnpaidBalanceBaseUnits      float64 `json:"unpaid"`
-		UnconfirmedBalanceBaseUnits float64 `json:"unconfirmed"`
-		CoinsPerMinute              float64 `json:"coinsPerMin"`
-		BTCPerMinute                float64 `json:"btcPerMin"`
-		USDPerMinute                float64 `json:"usdPerMin"`
-	} `json:"data"`
-}
-
-type minerWorkersAPIData struct {
-	baseAPIData
-	Data []minerWorkersAPIDataElement `json:"data"`
-}
-
-type minerWorkersAPIDataElement struct {
-	Name              string  `json:"worker"`
-	Timestamp         float64 `json:"time"`
-	LastSeenTimestamp float64 `json:"lastSeen"`
-	ReportedHashRate  float64 `json:"reportedHashrate"`
-	CurrentHashRate   float64 `json:"currentHashrate"`
-	ValidShares       float64 `json:"validShares"`
-	InvalidShares     float64 `json:"invalidShares"`
-	StaleShares       float64 `json:"staleShares"`
+	"ethermine":         {"ethermine", "Ethermine", CurrencySymbolEthereum, "https://api.ethermine.org", defaultPoolRateLimitPerMinute, defaultPoolRateLimitBurst},
+	"ethermine-etc":     {"ethermine-etc", "ETC Ethermine", CurrencySymbolEthereumClassic, "https://api-etc.ethermine.org", defaultPoolRateLimitPerMinute, defaultPoolRateLimitBurst},
+	"ethpool":           {"ethpool", "Ethpool", CurrencySymbolEthereum, "https://api.ethpool.org", defaultPoolRateLimitPerMinute, defaultPoolRateLimitBurst},
+	"flypool-zcash":     {"flypool-zcash", "Zcash Flypool", CurrencySymbolZcash, "https://api-zcash.flypool.org", defaultPoolRateLimitPerMinute, defaultPoolRateLimitBurst},
+	"flypool-ravencoin": {"flypool-ravencoin", "Ravencoin Flypool", CurrencySymbolRavencoin, "https://api-ravencoin.flypool.org", defaultPoolRateLimitPerMinute, defaultPoolRateLimitBurst},
+	"flypool-beam":      {"flypool-beam", "Flypool BEAM", CurrencySymbolBEAM, "https://api-beam.flypool.org", defaultPoolRateLimitPerMinute, defaultPoolRateLimitBurst},
 }
 
 const namespace = "ethermine"
-
-const poolBasicAPIURLSuffix = "/poolStats"
-const poolNetworkAPIURLSuffix = "/networkStats"
-const poolServerAPIURLSuffix = "/servers/history"
-const minerStatsAPIURLSuffixTemplate = "/miner/<miner>/currentStats"
-const minerWorkersAPIURLSuffixTemplate = "/miner/<miner>/workers"
+const envPrefix = "ETHERMINE_EXPORTER_"
 
 const defaultDebug = false
 const defaultEndpoint = ":8080"
-
+const defaultTopMinersMaxRank = 10
+const defaultMinerUseDashboard = false
+const defaultMinerMaxConcurrency = 4
+const defaultPollerInterval = 0
+const defaultPollerExpiry = 1 * time.Hour
+const defaultRateLimitMaxWait = 10 * time.Second
+const defaultStaleMaxAge = 0
+const defaultCircuitFailureThreshold = 5
+const defaultCircuitOpenDuration = 1 * time.Minute
+const defaultHTTPConnectTimeout = 5 * time.Second
+const defaultHTTPTimeout = 10 * time.Second
+const defaultHTTPMaxRetries = 2
+const defaultHTTPBackoffInitial = 1 * time.Second
+const defaultHTTPBackoffMax = 10 * time.Second
+const defaultHTTPScrapeTimeoutOffset = 500 * time.Millisecond
+const defaultSDTargetAddress = ""
+
+var configFile = ""
 var enableDebug = false
 var endpoint = defaultEndpoint
+var topMinersMaxRank = defaultTopMinersMaxRank
+var minerUseDashboard = defaultMinerUseDashboard
+var minerMaxConcurrency = defaultMinerMaxConcurrency
+var pollerInterval time.Duration = defaultPollerInterval
+var pollerExpiry time.Duration = defaultPollerExpiry
+var rateLimitMaxWait time.Duration = defaultRateLimitMaxWait
+var staleMaxAge time.Duration = defaultStaleMaxAge
+var circuitFailureThreshold = defaultCircuitFailureThreshold
+var circuitOpenDuration time.Duration = defaultCircuitOpenDuration
+var httpClientOptions = util.HTTPClientOptions{
+	ConnectTimeout: defaultHTTPConnectTimeout,
+	Timeout:        defaultHTTPTimeout,
+	MaxRetries:     defaultHTTPMaxRetries,
+	BackoffInitial: defaultHTTPBackoffInitial,
+	BackoffMax:     defaultHTTPBackoffMax,
+}
+var httpScrapeTimeoutOffset time.Duration = defaultHTTPScrapeTimeoutOffset
+var sdTargetAddress = defaultSDTargetAddress
+
+// Where the arguments set explicitly were set ("argument" or "environment").
+var argSources map[string]string
+
+// Nil if disabled.
+var dataPoller *poller
+
+// Registry for metrics about the exporter itself, which live across requests.
+// Served separately from the pool and miner metrics.
+var exporterRegistry = prometheus.NewRegistry()
 
 func main() {
 	fmt.Printf("%s version %s by %s.\n", appName, appVersion, appAuthor)
 
 	parseCliArgs()
+	if err := loadConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return
+	}
+	exporterRegistry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	exporterRegistry.MustRegister(prometheus.NewGoCollector())
+	util.NewExporterMetric(exporterRegistry, namespace, appVersion)
+	configReloadSuccessMetric.Set(1)
+	configReloadTimestampMetric.SetToCurrentTime()
 	if enableDebug {
 		fmt.Printf("[DEBUG] Debug mode enabled.\n")
 	}
 
+	go reloadConfigOnSignal()
+
+	if pollerInterval > 0 {
+		fmt.Printf("Polling requested targets every %s.\n", pollerInterval)
+		dataPoller = newPoller(pollerInterval, pollerExpiry)
+		go dataPoller.run()
+	}
+
 	if err := runServer(); err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		return
@@ -159,11 +161,89 @@ func main() {
 }
 
 func parseCliArgs() {
+	flag.StringVar(&configFile, "config.file", "", "The YAML config file to load. Arguments and environment variables take precedence over the config file.")
 	flag.BoolVar(&enableDebug, "debug", defaultDebug, "Show debug messages.")
 	flag.StringVar(&endpoint, "endpoint", defaultEndpoint, "The address-port endpoint to bind to.")
+	flag.IntVar(&topMinersMaxRank, "pool.top-miners-max-rank", defaultTopMinersMaxRank, "The max rank of the top miners to export for pools (0 to disable).")
+	flag.BoolVar(&minerUseDashboard, "miner.dashboard", defaultMinerUseDashboard, "Use the dashboard API for miners, to reduce the number of API calls. The unconfirmed balance and income metrics are not available with the dashboard API.")
+	flag.IntVar(&minerMaxConcurrency, "miner.max-concurrency", defaultMinerMaxConcurrency, "The max number of miners to scrape concurrently for scrape requests with multiple miners (0 for unlimited).")
+	flag.DurationVar(&pollerInterval, "poller.interval", defaultPollerInterval, "The interval to scrape requested pools and miners at in the background, serving scrape requests from the cache (0 to disable and scrape on request).")
+	flag.DurationVar(&rateLimitMaxWait, "ratelimit.max-wait", defaultRateLimitMaxWait, "How long requests to the pool API may be delayed by the rate limiter before they're rejected instead.")
+	flag.IntVar(&circuitFailureThreshold, "circuit.failure-threshold", defaultCircuitFailureThreshold, "The number of consecutive failed requests to a pool API before its circuit breaker opens (0 to disable).")
+	flag.DurationVar(&circuitOpenDuration, "circuit.open-duration", defaultCircuitOpenDuration, "How long the circuit breaker stays open before a single request is allowed to probe if the pool API has recovered.")
+	registerHTTPClientFlags(flag.CommandLine, &httpClientOptions)
+	flag.DurationVar(&httpScrapeTimeoutOffset, "http.scrape-timeout-offset", defaultHTTPScrapeTimeoutOffset, "How much to subtract from the scrape timeout provided by Prometheus, to leave time for responding.")
+	flag.StringVar(&sdTargetAddress, "sd.target-address", defaultSDTargetAddress, "The address-port of the exporter to use for the targets from the service discovery endpoint (uses the host of the service discovery request if not set).")
+	flag.DurationVar(&staleMaxAge, "stale.max-age", defaultStaleMaxAge, "How old the data from the last successful pool API call may be to be used when the pool API fails (0 to disable).")
+	flag.DurationVar(&pollerExpiry, "poller.expiry", defaultPollerExpiry, "How long to keep polling a pool or miner after it was last requested.")
 
 	// Exits on error
 	flag.Parse()
+
+	if err := setArgsFromEnv(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(2)
+	}
+}
+
+// Use environment variables for arguments not set on the command line, and record where each argument was set from.
+func setArgsFromEnv() error {
+	argSources = make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		argSources[f.Name] = "argument"
+	})
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || argSources[f.Name] != "" {
+			return
+		}
+		envName := getArgEnvName(f.Name)
+		if value, ok := os.LookupEnv(envName); ok {
+			if setErr := flag.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value for environment variable %s: %s", envName, setErr)
+				return
+			}
+			argSources[f.Name] = "environment"
+		}
+	})
+	return err
+}
+
+// Get the environment variable name for the argument, e.g. ETHERMINE_EXPORTER_HTTP_CONNECT_TIMEOUT for http.connect-timeout.
+func getArgEnvName(argName string) string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(argName))
+}
+
+// Register the arguments for the HTTP client options, which are also used when reloading the config.
+func registerHTTPClientFlags(flagSet *flag.FlagSet, options *util.HTTPClientOptions) {
+	flagSet.DurationVar(&options.ConnectTimeout, "http.connect-timeout", defaultHTTPConnectTimeout, "The timeout for connecting to the pool API.")
+	flagSet.DurationVar(&options.Timeout, "http.timeout", defaultHTTPTimeout, "The timeout for each request attempt to the pool API, including reading the response.")
+	flagSet.IntVar(&options.MaxRetries, "http.retries", defaultHTTPMaxRetries, "The max number of retries for failed requests to the pool API.")
+	flagSet.DurationVar(&options.BackoffInitial, "http.backoff-initial", defaultHTTPBackoffInitial, "The backoff before the first retry, doubled for each subsequent retry and randomized.")
+	flagSet.DurationVar(&options.BackoffMax, "http.backoff-max", defaultHTTPBackoffMax, "The max backoff between retries.")
+	flagSet.StringVar(&options.ProxyURL, "http.proxy-url", "", "The HTTP, HTTPS or SOCKS5 proxy URL to use for the pool API, optionally with credentials (uses the proxy environment variables if not set).")
+	flagSet.StringVar(&options.CAFile, "http.ca-file", "", "A PEM file with extra CA certificates to trust for the pool API, in addition to the system ones.")
+	flagSet.StringVar(&options.CertFile, "http.cert-file", "", "A PEM file with the client certificate to use for the pool API.")
+	flagSet.StringVar(&options.KeyFile, "http.key-file", "", "A PEM file with the key for the client certificate.")
+	flagSet.StringVar(&options.TLSMinVersion, "http.tls-min-version", "", "The min TLS version to use for the pool API (1.0, 1.1, 1.2 or 1.3).")
+}
+
+// Reload the config when receiving SIGHUP, never returns.
+func reloadConfigOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		reloadConfigAndLog()
+	}
+}
+
+func reloadConfigAndLog() error {
+	fmt.Printf("Reloading config.\n")
+	if err := reloadConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to reload config: %s\n", err)
+		return err
+	}
+	return nil
 }
 
 func runServer() error {
@@ -172,6 +252,10 @@ func runServer() error {
 	mainServeMux.HandleFunc("/", handleOtherRequest)
 	mainServeMux.HandleFunc("/pool", handlePoolScrapeRequest)
 	mainServeMux.HandleFunc("/miner", handleMinerScrapeRequest)
+	mainServeMux.HandleFunc("/metrics", handleStaticScrapeRequest)
+	mainServeMux.Handle("/metrics-self", promhttp.HandlerFor(exporterRegistry, promhttp.HandlerOpts{}))
+	mainServeMux.HandleFunc("/sd", handleServiceDiscoveryRequest)
+	mainServeMux.HandleFunc("/-/reload", handleReloadRequest)
 	if err := http.ListenAndServe(endpoint, &mainServeMux); err != nil {
 		return fmt.Errorf("Error while running main HTTP server: %s", err)
 	}
@@ -181,19 +265,53 @@ func runServer() error {
 func handleOtherRequest(response http.ResponseWriter, request *http.Request) {
 	if request.URL.Path == "/" {
 		fmt.Fprintf(response, "%s version %s by %s.\n", appName, appVersion, appAuthor)
-		fmt.Fprintf(response, "\nPool IDs:\n")
-		for poolID := range Pools {
-			fmt.Fprintf(response, "- %s\n", poolID)
+		activeConfig := getActiveConfig()
+		fmt.Fprintf(response, "\nPools:\n")
+		poolIDs := make([]string, 0, len(activeConfig.pools))
+		for poolID := range activeConfig.pools {
+			poolIDs = append(poolIDs, poolID)
+		}
+		sort.Strings(poolIDs)
+		for _, poolID := range poolIDs {
+			pool := activeConfig.pools[poolID]
+			fmt.Fprintf(response, "- %s: %s (%s, %s)\n", pool.ID, pool.Name, pool.Currency, pool.APIURL)
+		}
+		if len(activeConfig.miners) > 0 {
+			fmt.Fprintf(response, "\nConfigured miners:\n")
+			for _, minerEntry := range activeConfig.miners {
+				if minerEntry.Alias != "" {
+					fmt.Fprintf(response, "- %s: /miner?pool=%s&target=%s\n", minerEntry.Alias, minerEntry.Pool, minerEntry.Address)
+				} else {
+					fmt.Fprintf(response, "- /miner?pool=%s&target=%s\n", minerEntry.Pool, minerEntry.Address)
+				}
+			}
 		}
 		fmt.Fprintf(response, "\nMetrics paths:\n")
-		fmt.Fprintf(response, "- Pool: /pool?pool=<pool>\n")
-		fmt.Fprintf(response, "- Miner: /miner?pool=<pool>&target=<miner-address>\n")
+		fmt.Fprintf(response, "- Pool: /pool?pool=<pool>[&server_history=true][&network=true][&blocks=true]\n")
+		fmt.Fprintf(response, "- Miner: /miner?pool=<pool>&target=<miner-address>[&target=<miner-address>...][&payouts=true][&rounds=true][&settings=true][&worker_history=true]\n")
+		fmt.Fprintf(response, "- Miner group: /miner?group=<group>[&payouts=true][&rounds=true][&settings=true][&worker_history=true]\n")
+		fmt.Fprintf(response, "- Configured pools and miners: /metrics\n")
+		fmt.Fprintf(response, "- Exporter itself: /metrics-self\n")
+		fmt.Fprintf(response, "\nService discovery path (for Prometheus HTTP SD):\n")
+		fmt.Fprintf(response, "- Configured miners: /sd\n")
 	} else {
 		message := fmt.Sprintf("404 - Page not found.\n")
 		http.Error(response, message, 404)
 	}
 }
 
+func handleReloadRequest(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(response, "405 - Only POST requests allowed.\n", 405)
+		return
+	}
+	if err := reloadConfigAndLog(); err != nil {
+		http.Error(response, fmt.Sprintf("500 - Failed to reload config: %s\n", err), 500)
+		return
+	}
+	fmt.Fprintf(response, "Config reloaded.\n")
+}
+
 func handlePoolScrapeRequest(response http.ResponseWriter, request *http.Request) {
 	if enableDebug {
 		fmt.Printf("[DEBUG] Request: endpoint=%s from=%s to=%v\n", "pool", request.RemoteAddr, request.URL.String())
@@ -207,28 +325,41 @@ func handlePoolScrapeRequest(response http.ResponseWriter, request *http.Request
 		http.Error(response, "400 - Missing pool.\n", 400)
 		return
 	}
-	pool, poolOK := Pools[poolID]
+	pool, poolOK := getActiveConfig().pools[poolID]
 	if !poolOK {
 		http.Error(response, "400 - Invalid pool.\n", 400)
 		return
 	}
 
-	// Scrape target and parse data
-	var basicData poolBasicAPIData
-	if !scrapeParse(&basicData, response, pool.APIURL+poolBasicAPIURLSuffix) {
+	// Get options
+	var options poolOptions
+	var parseErr error
+	if options.serverHistory, parseErr = getBoolQueryParam(request, "server_history"); parseErr != nil {
+		http.Error(response, "400 - Invalid server history option.\n", 400)
+		return
+	}
+	if options.network, parseErr = getBoolQueryParam(request, "network"); parseErr != nil {
+		http.Error(response, "400 - Invalid network option.\n", 400)
 		return
 	}
-	var serverData poolServerAPIData
-	if !scrapeParse(&serverData, response, pool.APIURL+poolServerAPIURLSuffix) {
+	if options.blocks, parseErr = getBoolQueryParam(request, "blocks"); parseErr != nil {
+		http.Error(response, "400 - Invalid blocks option.\n", 400)
 		return
 	}
 
-	// Build registry with data
-	registry := buildPoolRegistry(response, &pool, &basicData, &serverData)
-	if registry == nil {
+	// Scrape target and parse data (or get from cache), only failing for client errors
+	ctx, cancel := getScrapeContext(request)
+	defer cancel()
+	result := &poolResult{pool: pool, options: options}
+	result.data, result.err = getPoolData(ctx, &pool, options)
+	if isClientError(result.err) {
+		writeScrapeError(response, result.err)
 		return
 	}
 
+	// Build registry with data
+	registry := buildPoolRegistry(result)
+
 	// Delegare final handling to Prometheus
 	handler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
 	handler.ServeHTTP(response, request)
@@ -238,188 +369,357 @@ func handleMinerScrapeRequest(response http.ResponseWriter, request *http.Reques
 	if enableDebug {
 		fmt.Printf("[DEBUG] Request: endpoint=%s from=%s to=%v\n", "miner", request.RemoteAddr, request.URL.String())
 	}
+	activeConfig := getActiveConfig()
+	var results []*minerResult
+	minerKeys := make(map[string]bool)
+	addMiner := func(pool Pool, minerAddress string) {
+		minerKey := pool.ID + "/" + minerAddress
+		if !minerKeys[minerKey] {
+			minerKeys[minerKey] = true
+			results = append(results, &minerResult{pool: pool, minerAddress: minerAddress})
+		}
+	}
 
-	// Get pool
-	var poolID string
-	if values, ok := request.URL.Query()["pool"]; ok && len(values) > 0 && values[0] != "" {
-		poolID = values[0]
-	} else {
-		http.Error(response, "400 - Missing pool.\n", 400)
-		return
+	// Get miners from groups
+	for _, groupName := range request.URL.Query()["group"] {
+		found := false
+		for _, minerEntry := range activeConfig.miners {
+			if minerEntry.hasGroup(groupName) {
+				addMiner(activeConfig.pools[minerEntry.Pool], minerEntry.Address)
+				found = true
+			}
+		}
+		if !found {
+			http.Error(response, "404 - Group not found.\n", 404)
+			return
+		}
 	}
-	pool, poolOK := Pools[poolID]
-	if !poolOK {
-		http.Error(response, "404 - Pool not found.\n", 404)
-		return
+
+	// Get miner addresses for pool (optional if using groups)
+	if len(results) == 0 || len(request.URL.Query()["target"]) > 0 {
+		// Get pool
+		var poolID string
+		if values, ok := request.URL.Query()["pool"]; ok && len(values) > 0 && values[0] != "" {
+			poolID = values[0]
+		} else {
+			http.Error(response, "400 - Missing pool.\n", 400)
+			return
+		}
+		pool, poolOK := activeConfig.pools[poolID]
+		if !poolOK {
+			http.Error(response, "404 - Pool not found.\n", 404)
+			return
+		}
+
+		// Get miner addresses
+		for _, minerAddress := range request.URL.Query()["target"] {
+			if minerAddress != "" {
+				addMiner(pool, minerAddress)
+			}
+		}
+		if len(results) == 0 {
+			http.Error(response, "400 - Missing miner address.\n", 400)
+			return
+		}
 	}
 
-	// Get miner address
-	var minerAddress string
-	if values, ok := request.URL.Query()["target"]; ok && len(values) > 0 && values[0] != "" {
-		minerAddress = values[0]
-	} else {
-		http.Error(response, "400 - Missing miner address.\n", 400)
+	// Get options
+	var options minerOptions
+	var parseErr error
+	if options.payouts, parseErr = getBoolQueryParam(request, "payouts"); parseErr != nil {
+		http.Error(response, "400 - Invalid payouts option.\n", 400)
 		return
 	}
-
-	// Scrape target and parse data
-	apiMinerStatsURL := strings.Replace(pool.APIURL+minerStatsAPIURLSuffixTemplate, "<miner>", minerAddress, 1)
-	var statsData minerStatsAPIData
-	if !scrapeParse(&statsData, response, apiMinerStatsURL) {
+	if options.rounds, parseErr = getBoolQueryParam(request, "rounds"); parseErr != nil {
+		http.Error(response, "400 - Invalid rounds option.\n", 400)
 		return
 	}
-	apiMinerWorkersURL := strings.Replace(pool.APIURL+minerWorkersAPIURLSuffixTemplate, "<miner>", minerAddress, 1)
-	var workersData minerWorkersAPIData
-	if !scrapeParse(&workersData, response, apiMinerWorkersURL) {
+	if options.settings, parseErr = getBoolQueryParam(request, "settings"); parseErr != nil {
+		http.Error(response, "400 - Invalid settings option.\n", 400)
+		return
+	}
+	if options.workerHistory, parseErr = getBoolQueryParam(request, "worker_history"); parseErr != nil {
+		http.Error(response, "400 - Invalid worker history option.\n", 400)
 		return
 	}
 
-	// Build registry with data
-	registry := buildMinerRegistry(response, &pool, minerAddress, &statsData, &workersData)
-	if registry == nil {
+	// Scrape targets and parse data (or get from cache), only failing if all miners failed due to client errors
+	for _, result := range results {
+		result.options = options
+	}
+	ctx, cancel := getScrapeContext(request)
+	defer cancel()
+	checkMinersRateLimitBudget(results)
+	getMinersData(ctx, results)
+	allClientErrors := true
+	for _, result := range results {
+		if !isClientError(result.err) {
+			allClientErrors = false
+			break
+		}
+	}
+	if allClientErrors {
+		writeScrapeError(response, results[0].err)
 		return
 	}
 
+	// Build registry with data
+	registry := buildMinerRegistry(results)
+
 	// Delegare final handling to Prometheus
 	handler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
 	handler.ServeHTTP(response, request)
 }
 
-// Scrape the HTTP target, parse the result and check if the result is OK.
-func scrapeParse(data interface{}, response http.ResponseWriter, targetURL string) bool {
-	// Scrape
-	rawData := util.ScrapeHTTPTarget(response, targetURL, enableDebug)
+// Scrape all pools and miners from the config, without failing if any of them fail.
+func handleStaticScrapeRequest(response http.ResponseWriter, request *http.Request) {
+	if enableDebug {
+		fmt.Printf("[DEBUG] Request: endpoint=%s from=%s to=%v\n", "metrics", request.RemoteAddr, request.URL.String())
+	}
+	activeConfig := getActiveConfig()
+
+	// Get configured pools and miners
+	var poolResults []*poolResult
+	for _, poolID := range activeConfig.staticPoolIDs {
+		poolResults = append(poolResults, &poolResult{
+			pool:    activeConfig.pools[poolID],
+			options: activeConfig.staticPoolOptions[poolID],
+		})
+	}
+	var minerResults []*minerResult
+	for _, minerEntry := range activeConfig.miners {
+		minerResults = append(minerResults, &minerResult{
+			pool:         activeConfig.pools[minerEntry.Pool],
+			minerAddress: minerEntry.Address,
+			options:      minerEntry.options(),
+		})
+	}
+
+	// Scrape targets and parse data (or get from cache)
+	ctx, cancel := getScrapeContext(request)
+	defer cancel()
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(2)
+	go func() {
+		defer waitGroup.Done()
+		getPoolsData(ctx, poolResults)
+	}()
+	go func() {
+		defer waitGroup.Done()
+		checkMinersRateLimitBudget(minerResults)
+		getMinersData(ctx, minerResults)
+	}()
+	waitGroup.Wait()
+
+	// Build registries with data
+	// Note: The scrape metrics shared by pools and miners use the same labels, with an empty miner label for pools.
+	minerRegistry := buildMinerRegistry(minerResults)
+	poolRegistry := buildPoolResultsRegistry(poolResults)
+
+	// Delegare final handling to Prometheus
+	handler := promhttp.HandlerFor(prometheus.Gatherers{minerRegistry, poolRegistry}, promhttp.HandlerOpts{})
+	handler.ServeHTTP(response, request)
+}
+
+// Prometheus HTTP SD target group.
+type sdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
 
-	// Check status
-	var baseData baseAPIData
-	if !util.ParseJSON(&baseData, response, rawData, false, enableDebug) {
-		return false
+// List the configured miners as targets for Prometheus HTTP SD, each with the miner endpoint parameters as labels.
+func handleServiceDiscoveryRequest(response http.ResponseWriter, request *http.Request) {
+	if enableDebug {
+		fmt.Printf("[DEBUG] Request: endpoint=%s from=%s to=%v\n", "sd", request.RemoteAddr, request.URL.String())
 	}
-	if baseData.Status != "OK" {
-		http.Error(response, "500 - API data not OK.\n", 500)
-		return false
+	targetAddress := sdTargetAddress
+	if targetAddress == "" {
+		targetAddress = request.Host
 	}
 
-	// Check if no data (ignore failed parse)
-	var noDataData noDataAPIData
-	if util.ParseJSON(&noDataData, response, rawData, true, enableDebug) {
-		if noDataData.Data == "NO DATA" {
-			http.Error(response, "404 - API data not found for pool.\n", 404)
-			return false
+	targetGroups := make([]sdTargetGroup, 0)
+	for _, minerEntry := range getActiveConfig().miners {
+		labels := map[string]string{
+			"__metrics_path__": "/miner",
+			"__param_pool":     minerEntry.Pool,
+			"__param_target":   minerEntry.Address,
+			"instance":         minerEntry.Address,
+		}
+		if minerEntry.Payouts {
+			labels["__param_payouts"] = "true"
+		}
+		if minerEntry.Rounds {
+			labels["__param_rounds"] = "true"
 		}
+		if minerEntry.Settings {
+			labels["__param_settings"] = "true"
+		}
+		if minerEntry.WorkerHistory {
+			labels["__param_worker_history"] = "true"
+		}
+		if minerEntry.Alias != "" {
+			labels["alias"] = minerEntry.Alias
+		}
+		targetGroups = append(targetGroups, sdTargetGroup{
+			Targets: []string{targetAddress},
+			Labels:  labels,
+		})
 	}
 
-	// Parse final data
-	return util.ParseJSON(&data, response, rawData, false, enableDebug)
+	response.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(response).Encode(targetGroups); err != nil && enableDebug {
+		fmt.Printf("[DEBUG] Failed to write service discovery response: %v\n", err)
+	}
 }
 
-// Builds a new registry for the pool endpoint, adds scraped data to it and returns it if successful or nil if not.
-func buildPoolRegistry(response http.ResponseWriter, pool *Pool, basicData *poolBasicAPIData, serverData *poolServerAPIData) *prometheus.Registry {
-	registry := prometheus.NewRegistry()
-	registry.MustRegister(prometheus.NewGoCollector())
-
-	util.NewExporterMetric(registry, namespace, appVersion)
-
-	constLabels := prometheus.Labels{
-		"pool":      pool.ID,
-		"pool_name": pool.Name,
-	}
-
-	// Pool info
-	util.NewGauge(registry, namespace, "pool", "info", "Metadata about the pool.", util.MergeLabels(constLabels, prometheus.Labels{
-		"currency": string(pool.Currency),
-	})).Set(1)
-
-	// Basic stats
-	util.NewGauge(registry, namespace, "pool", "hashrate_hps", "Current total hash rate of the pool (H/s).", constLabels).Set(basicData.Data.Stats.HashRate)
-	util.NewGauge(registry, namespace, "pool", "miner_count", "Current total number of miners in the pool.", constLabels).Set(basicData.Data.Stats.MinerCount)
-	util.NewGauge(registry, namespace, "pool", "worker_count", "Current total number of workers in the pool.", constLabels).Set(basicData.Data.Stats.WorkerCount)
-	util.NewGauge(registry, namespace, "pool", "price_usd", "Current price (USD).", constLabels).Set(basicData.Data.Price.USD)
-	util.NewGauge(registry, namespace, "pool", "price_btc", "Current price (BTC).", constLabels).Set(basicData.Data.Price.BTC)
-
-	// Server stats
-	lastServerElements := make(map[string]*poolServerAPIDataElement)
-	for _, element := range serverData.Data {
-		existingElement, exists := lastServerElements[element.Server]
-		if !exists || element.Time > existingElement.Time {
-			var elementClone poolServerAPIDataElement
-			elementClone = element
-			lastServerElements[element.Server] = &elementClone
+// Get the boolean query parameter, or false if not set.
+func getBoolQueryParam(request *http.Request, name string) (bool, error) {
+	if values, ok := request.URL.Query()[name]; ok && len(values) > 0 && values[0] != "" {
+		return strconv.ParseBool(values[0])
+	}
+	return false, nil
+}
+
+// Get the context for scraping the pool API for the request, with the scrape timeout from Prometheus if provided.
+func getScrapeContext(request *http.Request) (context.Context, context.CancelFunc) {
+	if value := request.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); value != "" {
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+			timeout := time.Duration(seconds*float64(time.Second)) - httpScrapeTimeoutOffset
+			if timeout > 0 {
+				return context.WithTimeout(request.Context(), timeout)
+			}
 		}
 	}
-	serverLabels := make(prometheus.Labels)
-	serverLabels["server"] = ""
-	serverHashRateMetric := util.NewGaugeVec(registry, namespace, "pool", "server_hashrate_hps", "Current hash rate per server (H/s).", constLabels, serverLabels)
-	for server, element := range lastServerElements {
-		labels := make(prometheus.Labels)
-		labels["server"] = server
-		serverHashRateMetric.With(labels).Set(element.HashRate)
+	return context.WithCancel(request.Context())
+}
+
+// Get the data for the pool, from the poller cache if enabled or else directly from the pool API.
+func getPoolData(ctx context.Context, pool *Pool, options poolOptions) (*poolData, error) {
+	if dataPoller == nil {
+		return scrapePoolData(ctx, pool, options)
 	}
+	poolID := pool.ID
+	// The server history option doesn't change what is scraped
+	key := fmt.Sprintf("pool/%s?network=%t&blocks=%t", pool.ID, options.network, options.blocks)
+	data, err := dataPoller.get(ctx, key, func(lastData interface{}) (interface{}, error) {
+		// Get the current pool, in case it changed since the target was registered
+		pool, ok := getActiveConfig().pools[poolID]
+		if !ok {
+			return nil, &scrapeError{404, "Pool not found."}
+		}
+		data, err := scrapePoolData(context.Background(), &pool, options)
+		if err != nil && lastData != nil && canUsePolledStaleData(lastData.(*poolData).dataTime, err) {
+			if enableDebug {
+				fmt.Printf("[DEBUG] Poller: Using data from last successful scrape for pool %s: %v\n", poolID, err)
+			}
+			return lastData.(*poolData).asStale(data.endpoints), nil
+		}
+		return data, err
+	})
+	if data == nil {
+		return nil, err
+	}
+	return data.(*poolData), err
+}
 
-	return registry
+// Get the data for the pools concurrently and store the data or error in the results.
+func getPoolsData(ctx context.Context, results []*poolResult) {
+	var waitGroup sync.WaitGroup
+	for _, result := range results {
+		waitGroup.Add(1)
+		go func(result *poolResult) {
+			defer waitGroup.Done()
+			result.data, result.err = getPoolData(ctx, &result.pool, result.options)
+			if result.err != nil && enableDebug {
+				fmt.Printf("[DEBUG] Failed to get data for pool %s: %v\n", result.pool.ID, result.err)
+			}
+		}(result)
+	}
+	waitGroup.Wait()
 }
 
-// Builds a new registry for the miner endpoint, adds scraped data to it and returns it if successful or nil if not.
-func buildMinerRegistry(response http.ResponseWriter, pool *Pool, minerAddress string, statsData *minerStatsAPIData, workersData *minerWorkersAPIData) *prometheus.Registry {
-	registry := prometheus.NewRegistry()
-	registry.MustRegister(prometheus.NewGoCollector())
+// Mark the miners that don't fit within what the rate limiters currently allow without rejecting requests to be scraped without calling the pool API,
+// such that the rest can be scraped instead of all of them waiting and some failing anyway. Stale data is still used for the marked miners if enabled.
+// Not used with the poller, which scrapes the miners in the background, or for a single miner.
+func checkMinersRateLimitBudget(results []*minerResult) {
+	if dataPoller != nil || len(results) <= 1 {
+		return
+	}
+	budgets := make(map[string]int)
+	for _, result := range results {
+		host := getAPIHost(&result.pool)
+		budget, exists := budgets[host]
+		if !exists {
+			budget = getRateLimiter(&result.pool).Available()
+		}
+		callCount := getMinerAPICallCount(result.options)
+		if callCount > budget {
+			if enableDebug {
+				fmt.Printf("[DEBUG] Skipping miner %s in pool %s due to the rate limit.\n", result.minerAddress, result.pool.ID)
+			}
+			result.upstreamErr = &scrapeError{503, "Rate limit exceeded for the request, use the poller or fewer miners per request."}
+			continue
+		}
+		budgets[host] = budget - callCount
+	}
+}
 
-	util.NewExporterMetric(registry, namespace, appVersion)
+// Get the data for the miners concurrently and store the data or error in the results.
+// The number of concurrent scrapes is limited by the max miner concurrency.
+func getMinersData(ctx context.Context, results []*minerResult) {
+	workerCount := minerMaxConcurrency
+	if workerCount > len(results) || workerCount < 1 {
+		workerCount = len(results)
+	}
+	jobs := make(chan *minerResult)
+	var waitGroup sync.WaitGroup
+	for i := 0; i < workerCount; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for result := range jobs {
+				if result.upstreamErr != nil {
+					result.data, result.err = scrapeMinerDataWithoutAPI(ctx, &result.pool, result.minerAddress, result.options, result.upstreamErr)
+				} else {
+					result.data, result.err = getMinerData(ctx, &result.pool, result.minerAddress, result.options)
+				}
+				if result.err != nil && enableDebug {
+					fmt.Printf("[DEBUG] Failed to get data for miner %s in pool %s: %v\n", result.minerAddress, result.pool.ID, result.err)
+				}
+			}
+		}()
+	}
+	for _, result := range results {
+		jobs <- result
+	}
+	close(jobs)
+	waitGroup.Wait()
+}
 
-	// Note: Miner address isn't needed as it's the instance/target of the scrape.
-	constLabels := prometheus.Labels{
-		"pool":  pool.ID,
-		"miner": minerAddress,
+// Get the data for the miner, from the poller cache if enabled or else directly from the pool API.
+func getMinerData(ctx context.Context, pool *Pool, minerAddress string, options minerOptions) (*minerData, error) {
+	if dataPoller == nil {
+		return scrapeMinerData(ctx, pool, minerAddress, options)
 	}
-	constLabelsWithCurrency := util.MergeLabels(constLabels, prometheus.Labels{
-		"currency": string(pool.Currency),
+	poolID := pool.ID
+	key := fmt.Sprintf("miner/%s/%s?payouts=%t&rounds=%t&settings=%t&worker_history=%t", pool.ID, minerAddress, options.payouts, options.rounds, options.settings, options.workerHistory)
+	data, err := dataPoller.get(ctx, key, func(lastData interface{}) (interface{}, error) {
+		// Get the current pool, in case it changed since the target was registered
+		pool, ok := getActiveConfig().pools[poolID]
+		if !ok {
+			return nil, &scrapeError{404, "Pool not found."}
+		}
+		data, err := scrapeMinerData(context.Background(), &pool, minerAddress, options)
+		if err != nil && lastData != nil && canUsePolledStaleData(lastData.(*minerData).dataTime, err) {
+			if enableDebug {
+				fmt.Printf("[DEBUG] Poller: Using data from last successful scrape for miner %s in pool %s: %v\n", minerAddress, poolID, err)
+			}
+			return lastData.(*minerData).asStale(data.endpoints), nil
+		}
+		return data, err
 	})
-	baseUnitsPerUnit := Currencies[pool.Currency].BaseUnitsPerUnit
-
-	// Miner info
-	util.NewGauge(registry, namespace, "miner", "info", "Metadata about the miner.", util.MergeLabels(constLabels, prometheus.Labels{
-		"pool_name":     pool.Name,
-		"pool_currency": string(pool.Currency),
-	})).Set(1)
-
-	// Miner stats
-	util.NewGauge(registry, namespace, "miner", "last_seen_seconds", "Delta between time of last statistics entry and when any workers from the miner was last seen (s).", constLabels).Set(statsData.Data.Timestamp - statsData.Data.LastSeenTimestamp)
-	util.NewGauge(registry, namespace, "miner", "hashrate_reported_hps", "Total hash rate for a miner as reported by the miner (H/s).", constLabels).Set(statsData.Data.ReportedHashRate)
-	util.NewGauge(registry, namespace, "miner", "hashrate_current_hps", "Total current hash rate for a miner (H/s).", constLabels).Set(statsData.Data.CurrentHashRate)
-	util.NewGauge(registry, namespace, "miner", "hashrate_average_hps", "Total average hash rate for a miner (H/s).", constLabels).Set(statsData.Data.AverageHashRate)
-	util.NewGauge(registry, namespace, "miner", "shares_valid", "Total number of valid shares for a miner.", constLabels).Set(statsData.Data.ValidShares)
-	util.NewGauge(registry, namespace, "miner", "shares_invalid", "Total number of invalid shares for a miner.", constLabels).Set(statsData.Data.InvalidShares)
-	util.NewGauge(registry, namespace, "miner", "shares_stale", "Total number of stale shares for a miner.", constLabels).Set(statsData.Data.StaleShares)
-	util.NewGauge(registry, namespace, "miner", "workers_active", "Number of active workers.", constLabels).Set(statsData.Data.ActiveWorkers)
-	util.NewGauge(registry, namespace, "miner", "balance_unpaid_coins", "Unpaid balance for a miner.", constLabelsWithCurrency).Set(statsData.Data.UnpaidBalanceBaseUnits / baseUnitsPerUnit)
-	util.NewGauge(registry, namespace, "miner", "balance_unconfirmed_coins", "Unconfirmed balance for a miner.", constLabelsWithCurrency).Set(statsData.Data.UnconfirmedBalanceBaseUnits / baseUnitsPerUnit)
-	util.NewGauge(registry, namespace, "miner", "income_coins", "Mined coins per second.", constLabelsWithCurrency).Set(statsData.Data.CoinsPerMinute / 60)
-	util.NewGauge(registry, namespace, "miner", "income_usd", "Mined coins per second (converted to USD).", constLabels).Set(statsData.Data.USDPerMinute / 60)
-	util.NewGauge(registry, namespace, "miner", "income_btc", "Mined coins per second (converted to BTC).", constLabels).Set(statsData.Data.BTCPerMinute / 60)
-	// Deprecated
-	util.NewGauge(registry, namespace, "miner", "income_minute_coins", "(Deprecated) Mined coins per minute.", constLabelsWithCurrency).Set(statsData.Data.CoinsPerMinute)
-	util.NewGauge(registry, namespace, "miner", "income_minute_usd", "(Deprecated) Mined coins per minute (converted to USD).", constLabels).Set(statsData.Data.USDPerMinute)
-	util.NewGauge(registry, namespace, "miner", "income_minute_btc", "(Deprecated) Mined coins per minute (converted to BTC).", constLabels).Set(statsData.Data.BTCPerMinute)
-
-	// Worker stats
-	workerLabels := make(prometheus.Labels)
-	workerLabels["worker"] = ""
-	workerLastSeenMetric := util.NewGaugeVec(registry, namespace, "worker", "last_seen_seconds", "Delta between time of last statistics entry and when the miner was last seen (s).", constLabels, workerLabels)
-	workerReportedHashRateMetric := util.NewGaugeVec(registry, namespace, "worker", "hashrate_reported_hps", "Current hash rate for a worker as reported from the worker (H/s).", constLabels, workerLabels)
-	workerCurrentHashRateMetric := util.NewGaugeVec(registry, namespace, "worker", "hashrate_current_hps", "Current hash rate for a worker (H/s).", constLabels, workerLabels)
-	workerValidSharesMetric := util.NewGaugeVec(registry, namespace, "worker", "shares_valid", "Number of valid shared for a worker.", constLabels, workerLabels)
-	workerInvalidSharesMetric := util.NewGaugeVec(registry, namespace, "worker", "shares_invalid", "Number of invalid shared for a worker.", constLabels, workerLabels)
-	workerStaleSharesMetric := util.NewGaugeVec(registry, namespace, "worker", "shares_stale", "Number of stale shared for a worker.", constLabels, workerLabels)
-	for _, element := range workersData.Data {
-		labels := make(prometheus.Labels)
-		labels["worker"] = element.Name
-		workerLastSeenMetric.With(labels).Set(element.Timestamp - element.LastSeenTimestamp)
-		workerReportedHashRateMetric.With(labels).Set(element.ReportedHashRate)
-		workerCurrentHashRateMetric.With(labels).Set(element.CurrentHashRate)
-		workerValidSharesMetric.With(labels).Set(element.ValidShares)
-		workerInvalidSharesMetric.With(labels).Set(element.InvalidShares)
-		workerStaleSharesMetric.With(labels).Set(element.StaleShares)
-	}
-
-	return registry
+	if data == nil {
+		return nil, err
+	}
+	return data.(*minerData), err
 }
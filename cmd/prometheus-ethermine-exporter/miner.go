@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+
+	"dev.hon.one/prometheus-ethermine-exporter/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const minerStatsAPIURLSuffixTemplate = "/miner/<miner>/currentStats"
+const minerWorkersAPIURLSuffixTemplate = "/miner/<miner>/workers"
+const minerPayoutsAPIURLSuffixTemplate = "/miner/<miner>/payouts"
+const minerRoundsAPIURLSuffixTemplate = "/miner/<miner>/rounds"
+const minerSettingsAPIURLSuffixTemplate = "/miner/<miner>/settings"
+const minerWorkerHistoryAPIURLSuffixTemplate = "/miner/<miner>/worker/<worker>/history"
+const minerDashboardAPIURLSuffixTemplate = "/miner/<miner>/dashboard"
+
+type minerStatsAPIData struct {
+	baseAPIData
+	Data minerStatsAPIDataElement `json:"data"`
+}
+
+type minerStatsAPIDataElement struct {
+	Timestamp                   float64 `json:"time"`
+	LastSeenTimestamp           float64 `json:"lastSeen"`
+	ReportedHashRate            float64 `json:"reportedHashrate"`
+	CurrentHashRate             float64 `json:"currentHashrate"`
+	AverageHashRate             float64 `json:"averageHashrate"`
+	ValidShares                 float64 `json:"validShares"`
+	InvalidShares               float64 `json:"invalidShares"`
+	StaleShares                 float64 `json:"staleShares"`
+	ActiveWorkers               float64 `json:"activeWorkers"`
+	UnpaidBalanceBaseUnits      float64 `json:"unpaid"`
+	UnconfirmedBalanceBaseUnits float64 `json:"unconfirmed"`
+	CoinsPerMinute              float64 `json:"coinsPerMin"`
+	BTCPerMinute                float64 `json:"btcPerMin"`
+	USDPerMinute                float64 `json:"usdPerMin"`
+}
+
+type minerWorkersAPIData struct {
+	baseAPIData
+	Data []minerWorkersAPIDataElement `json:"data"`
+}
+
+type minerWorkersAPIDataElement struct {
+	Name              string  `json:"worker"`
+	Timestamp         float64 `json:"time"`
+	LastSeenTimestamp float64 `json:"lastSeen"`
+	ReportedHashRate  float64 `json:"reportedHashrate"`
+	CurrentHashRate   float64 `json:"currentHashrate"`
+	ValidShares       float64 `json:"validShares"`
+	InvalidShares     float64 `json:"invalidShares"`
+	StaleShares       float64 `json:"staleShares"`
+}
+
+type minerPayoutsAPIData struct {
+	baseAPIData
+	Data []minerPayoutsAPIDataElement `json:"data"`
+}
+
+type minerPayoutsAPIDataElement struct {
+	StartBlock      float64 `json:"start"`
+	EndBlock        float64 `json:"end"`
+	AmountBaseUnits float64 `json:"amount"`
+	TransactionHash string  `json:"txHash"`
+	PaidOnTimestamp float64 `json:"paidOn"`
+}
+
+type minerRoundsAPIData struct {
+	baseAPIData
+	Data []minerRoundsAPIDataElement `json:"data"`
+}
+
+type minerRoundsAPIDataElement struct {
+	Block           float64 `json:"block"`
+	AmountBaseUnits float64 `json:"amount"`
+}
+
+type minerSettingsAPIData struct {
+	baseAPIData
+	Data minerSettingsAPIDataElement `json:"data"`
+}
+
+type minerSettingsAPIDataElement struct {
+	Email              string  `json:"email"`
+	Monitor            float64 `json:"monitor"`
+	MinPayoutBaseUnits float64 `json:"minPayout"`
+	IPHash             string  `json:"ip"`
+}
+
+type minerWorkerHistoryAPIData struct {
+	baseAPIData
+	Data []minerWorkerHistoryAPIDataElement `json:"data"`
+}
+
+type minerWorkerHistoryAPIDataElement struct {
+	Timestamp        float64 `json:"time"`
+	ReportedHashRate float64 `json:"reportedHashrate"`
+	CurrentHashRate  float64 `json:"currentHashrate"`
+	ValidShares      float64 `json:"validShares"`
+	InvalidShares    float64 `json:"invalidShares"`
+	StaleShares      float64 `json:"staleShares"`
+}
+
+// Note: The current statistics lack the average hash rate, unconfirmed balance and income fields.
+type minerDashboardAPIData struct {
+	baseAPIData
+	Data struct {
+		Statistics []struct {
+			Timestamp        float64 `json:"time"`
+			ReportedHashRate float64 `json:"reportedHashrate"`
+			CurrentHashRate  float64 `json:"currentHashrate"`
+			ValidShares      float64 `json:"validShares"`
+			InvalidShares    float64 `json:"invalidShares"`
+			StaleShares      float64 `json:"staleShares"`
+			ActiveWorkers    float64 `json:"activeWorkers"`
+		} `json:"statistics"`
+		Workers           []minerWorkersAPIDataElement `json:"workers"`
+		CurrentStatistics minerStatsAPIDataElement     `json:"currentStatistics"`
+		Settings          minerSettingsAPIDataElement  `json:"settings"`
+	} `json:"data"`
+}
+
+// All scraped data for a miner.
+type minerData struct {
+	// Time of the oldest data.
+	dataTime time.Time
+	// If any of the data is stale.
+	stale    bool
+	stats    *minerStatsAPIData
+	workers  *minerWorkersAPIData
+	payouts  *minerPayoutsAPIData
+	rounds   *minerRoundsAPIData
+	settings *minerSettingsAPIData
+	// Nil if not enabled.
+	workerHistory map[string]*minerWorkerHistoryAPIData
+	// False if the stats lack the unconfirmed balance and income fields, e.g. if from the dashboard.
+	hasIncomeStats bool
+	// Results per API endpoint.
+	endpoints []*endpointResult
+}
+
+// Optional data to scrape for a miner, each requiring an extra API call.
+type minerOptions struct {
+	payouts bool
+	rounds  bool
+	// Always included when using the dashboard API.
+	settings bool
+	// Requires one API call per worker.
+	workerHistory bool
+}
+
+// Returns the number of pool API calls needed to scrape a miner.
+// The worker history calls are not included, since the number of workers isn't known in advance.
+func getMinerAPICallCount(options minerOptions) int {
+	// Stats and workers, or the dashboard
+	count := 2
+	if minerUseDashboard {
+		count = 1
+	} else if options.settings {
+		count++
+	}
+	if options.payouts {
+		count++
+	}
+	if options.rounds {
+		count++
+	}
+	return count
+}
+
+// Scrapes all data for the miner from the pool API.
+// If only some of the API calls fail, the data for those is left nil and the rest is returned.
+// If all of them fail or the pool API says there's no data for the miner, the error is returned together with the data containing only the endpoint results.
+func scrapeMinerData(ctx context.Context, pool *Pool, minerAddress string, options minerOptions) (*minerData, error) {
+	return scrapeMinerDataWithState(newScrapeState(ctx, pool), minerAddress, options)
+}
+
+// Scrapes the miner like scrapeMinerData, but fails all API calls with the error without calling the pool API.
+// Stale data is still used if enabled, and the failed calls are still recorded for the endpoint metrics.
+func scrapeMinerDataWithoutAPI(ctx context.Context, pool *Pool, minerAddress string, options minerOptions, err error) (*minerData, error) {
+	state := newScrapeState(ctx, pool)
+	state.upstreamErr = err
+	return scrapeMinerDataWithState(state, minerAddress, options)
+}
+
+func scrapeMinerDataWithState(state *scrapeState, minerAddress string, options minerOptions) (*minerData, error) {
+	pool := state.pool
+	var data minerData
+	if minerUseDashboard {
+		// Note: The dashboard replaces the stats, workers and settings API calls.
+		apiMinerDashboardURL := strings.Replace(pool.APIURL+minerDashboardAPIURLSuffixTemplate, "<miner>", minerAddress, 1)
+		var dashboardData minerDashboardAPIData
+		if err := state.scrapeParse(&dashboardData, apiMinerDashboardURL, "dashboard"); err != nil {
+			if isNoDataError(err) {
+				return &minerData{endpoints: state.endpoints}, err
+			}
+		} else {
+			data.stats = &minerStatsAPIData{baseAPIData: dashboardData.baseAPIData, Data: dashboardData.Data.CurrentStatistics}
+			data.workers = &minerWorkersAPIData{baseAPIData: dashboardData.baseAPIData, Data: dashboardData.Data.Workers}
+			data.settings = &minerSettingsAPIData{baseAPIData: dashboardData.baseAPIData, Data: dashboardData.Data.Settings}
+			// Calculate the average hash rate from the statistics history, like the pool does
+			if len(dashboardData.Data.Statistics) > 0 {
+				var totalHashRate float64
+				for _, element := range dashboardData.Data.Statistics {
+					totalHashRate += element.CurrentHashRate
+				}
+				data.stats.Data.AverageHashRate = totalHashRate / float64(len(dashboardData.Data.Statistics))
+			}
+		}
+	} else {
+		apiMinerStatsURL := strings.Replace(pool.APIURL+minerStatsAPIURLSuffixTemplate, "<miner>", minerAddress, 1)
+		var statsData minerStatsAPIData
+		if err := state.scrapeParse(&statsData, apiMinerStatsURL, "currentStats"); err != nil {
+			if isNoDataError(err) {
+				return &minerData{endpoints: state.endpoints}, err
+			}
+		} else {
+			data.stats = &statsData
+			data.hasIncomeStats = true
+		}
+		apiMinerWorkersURL := strings.Replace(pool.APIURL+minerWorkersAPIURLSuffixTemplate, "<miner>", minerAddress, 1)
+		var workersData minerWorkersAPIData
+		if err := state.scrapeParse(&workersData, apiMinerWorkersURL, "workers"); err == nil {
+			data.workers = &workersData
+		}
+		if options.settings {
+			apiMinerSettingsURL := strings.Replace(pool.APIURL+minerSettingsAPIURLSuffixTemplate, "<miner>", minerAddress, 1)
+			var settingsData minerSettingsAPIData
+			if err := state.scrapeParse(&settingsData, apiMinerSettingsURL, "settings"); err == nil {
+				data.settings = &settingsData
+			}
+		}
+	}
+	if options.payouts {
+		apiMinerPayoutsURL := strings.Replace(pool.APIURL+minerPayoutsAPIURLSuffixTemplate, "<miner>", minerAddress, 1)
+		var payoutsData minerPayoutsAPIData
+		if err := state.scrapeParse(&payoutsData, apiMinerPayoutsURL, "payouts"); err == nil {
+			data.payouts = &payoutsData
+		}
+	}
+	if options.rounds {
+		apiMinerRoundsURL := strings.Replace(pool.APIURL+minerRoundsAPIURLSuffixTemplate, "<miner>", minerAddress, 1)
+		var roundsData minerRoundsAPIData
+		if err := state.scrapeParse(&roundsData, apiMinerRoundsURL, "rounds"); err == nil {
+			data.rounds = &roundsData
+		}
+	}
+	// Note: Requires one API call per worker, so the workers are required. Failed workers are left out.
+	if options.workerHistory && data.workers != nil {
+		data.workerHistory = make(map[string]*minerWorkerHistoryAPIData)
+		for _, element := range data.workers.Data {
+			apiMinerWorkerHistoryURL := strings.Replace(pool.APIURL+minerWorkerHistoryAPIURLSuffixTemplate, "<miner>", minerAddress, 1)
+			apiMinerWorkerHistoryURL = strings.Replace(apiMinerWorkerHistoryURL, "<worker>", url.PathEscape(element.Name), 1)
+			var historyData minerWorkerHistoryAPIData
+			if err := state.scrapeParse(&historyData, apiMinerWorkerHistoryURL, "worker/history"); err == nil {
+				data.workerHistory[element.Name] = &historyData
+			}
+		}
+	}
+	data.dataTime = state.dataTime
+	data.stale = state.stale
+	data.endpoints = state.endpoints
+	return &data, state.allFailedError()
+}
+
+// Returns a copy of the data marked as stale, with the endpoint results from a failed scrape.
+func (data *minerData) asStale(endpoints []*endpointResult) *minerData {
+	staleData := *data
+	staleData.stale = true
+	staleData.endpoints = endpoints
+	return &staleData
+}
+
+// Result of scraping a single miner, for scrape requests with multiple miners.
+type minerResult struct {
+	pool         Pool
+	minerAddress string
+	options      minerOptions
+	// If set, the pool API is not called for the miner and the API calls fail with this error instead.
+	upstreamErr error
+	// Only contains the endpoint results if the scrape failed, or nil if the pool API wasn't called.
+	data *minerData
+	err  error
+}
+
+// Builds a new registry for the miner endpoint and adds the scraped data for all the miners to it.
+// Failed miners only get the scrape success metric and the endpoint metrics.
+// The data may be shared with other requests and must not be modified.
+func buildMinerRegistry(results []*minerResult) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	util.NewExporterMetric(registry, namespace, appVersion)
+
+	for _, result := range results {
+		constLabels := prometheus.Labels{
+			"pool":  result.pool.ID,
+			"miner": result.minerAddress,
+		}
+		successValue := 0.0
+		if result.err == nil {
+			successValue = 1
+		}
+		util.NewGauge(registry, namespace, "miner", "scrape_success", "If the miner data was successfully scraped (1) or not (0).", constLabels).Set(successValue)
+		if result.err == nil {
+			addMinerMetrics(registry, &result.pool, result.minerAddress, result.data)
+		} else if result.data != nil {
+			addEndpointMetrics(registry, getScrapeConstLabels(&result.pool, result.minerAddress), result.data.endpoints)
+		}
+	}
+
+	return registry
+}
+
+// Adds the metrics for the miner to the registry.
+func addMinerMetrics(registry *prometheus.Registry, pool *Pool, minerAddress string, data *minerData) {
+	// Note: Miner address is needed to distinguish the miners when scraping multiple miners.
+	constLabels := prometheus.Labels{
+		"pool":  pool.ID,
+		"miner": minerAddress,
+	}
+	constLabelsWithCurrency := util.MergeLabels(constLabels, prometheus.Labels{
+		"currency": string(pool.Currency),
+	})
+	baseUnitsPerUnit := getActiveConfig().currencies[pool.Currency].BaseUnitsPerUnit
+
+	// Miner info
+	util.NewGauge(registry, namespace, "miner", "info", "Metadata about the miner.", util.MergeLabels(constLabels, prometheus.Labels{
+		"pool_name":     pool.Name,
+		"pool_currency": string(pool.Currency),
+	})).Set(1)
+
+	// Scrape stats
+	scrapeConstLabels := getScrapeConstLabels(pool, minerAddress)
+	util.NewGauge(registry, namespace, "scrape", "data_age_seconds", "Time since the oldest data was scraped from the pool API (s).", scrapeConstLabels).Set(time.Since(data.dataTime).Seconds())
+	staleValue := 0.0
+	if data.stale {
+		staleValue = 1
+	}
+	util.NewGauge(registry, namespace, "scrape", "stale", "If any of the data is stale, from the last successful scrape after the pool API failed (1) or not (0).", scrapeConstLabels).Set(staleValue)
+	addEndpointMetrics(registry, scrapeConstLabels, data.endpoints)
+
+	// Miner stats
+	if data.stats != nil {
+		util.NewGauge(registry, namespace, "miner", "last_seen_seconds", "Delta between time of last statistics entry and when any workers from the miner was last seen (s).", constLabels).Set(data.stats.Data.Timestamp - data.stats.Data.LastSeenTimestamp)
+		util.NewGauge(registry, namespace, "miner", "hashrate_reported_hps", "Total hash rate for a miner as reported by the miner (H/s).", constLabels).Set(data.stats.Data.ReportedHashRate)
+		util.NewGauge(registry, namespace, "miner", "hashrate_current_hps", "Total current hash rate for a miner (H/s).", constLabels).Set(data.stats.Data.CurrentHashRate)
+		util.NewGauge(registry, namespace, "miner", "hashrate_average_hps", "Total average hash rate for a miner (H/s).", constLabels).Set(data.stats.Data.AverageHashRate)
+		util.NewGauge(registry, namespace, "miner", "shares_valid", "Total number of valid shares for a miner.", constLabels).Set(data.stats.Data.ValidShares)
+		util.NewGauge(registry, namespace, "miner", "shares_invalid", "Total number of invalid shares for a miner.", constLabels).Set(data.stats.Data.InvalidShares)
+		util.NewGauge(registry, namespace, "miner", "shares_stale", "Total number of stale shares for a miner.", constLabels).Set(data.stats.Data.StaleShares)
+		util.NewGauge(registry, namespace, "miner", "workers_active", "Number of active workers.", constLabels).Set(data.stats.Data.ActiveWorkers)
+		util.NewGauge(registry, namespace, "miner", "balance_unpaid_coins", "Unpaid balance for a miner.", constLabelsWithCurrency).Set(data.stats.Data.UnpaidBalanceBaseUnits / baseUnitsPerUnit)
+		if data.hasIncomeStats {
+			util.NewGauge(registry, namespace, "miner", "balance_unconfirmed_coins", "Unconfirmed balance for a miner.", constLabelsWithCurrency).Set(data.stats.Data.UnconfirmedBalanceBaseUnits / baseUnitsPerUnit)
+			util.NewGauge(registry, namespace, "miner", "income_coins", "Mined coins per second.", constLabelsWithCurrency).Set(data.stats.Data.CoinsPerMinute / 60)
+			util.NewGauge(registry, namespace, "miner", "income_usd", "Mined coins per second (converted to USD).", constLabels).Set(data.stats.Data.USDPerMinute / 60)
+			util.NewGauge(registry, namespace, "miner", "income_btc", "Mined coins per second (converted to BTC).", constLabels).Set(data.stats.Data.BTCPerMinute / 60)
+			// Deprecated
+			util.NewGauge(registry, namespace, "miner", "income_minute_coins", "(Deprecated) Mined coins per minute.", constLabelsWithCurrency).Set(data.stats.Data.CoinsPerMinute)
+			util.NewGauge(registry, namespace, "miner", "income_minute_usd", "(Deprecated) Mined coins per minute (converted to USD).", constLabels).Set(data.stats.Data.USDPerMinute)
+			util.NewGauge(registry, namespace, "miner", "income_minute_btc", "(Deprecated) Mined coins per minute (converted to BTC).", constLabels).Set(data.stats.Data.BTCPerMinute)
+		}
+	}
+
+	// Miner settings
+	if data.settings != nil {
+		util.NewGauge(registry, namespace, "miner", "payout_threshold_coins", "Minimum balance before a payout is made to a miner.", constLabelsWithCurrency).Set(data.settings.Data.MinPayoutBaseUnits / baseUnitsPerUnit)
+		util.NewGauge(registry, namespace, "miner", "email_alerts_enabled", "If email alerts are enabled for a miner (1) or not (0).", constLabels).Set(data.settings.Data.Monitor)
+		if data.stats != nil && data.hasIncomeStats {
+			payoutRemainingCoins := math.Max(0, (data.settings.Data.MinPayoutBaseUnits-data.stats.Data.UnpaidBalanceBaseUnits)/baseUnitsPerUnit)
+			payoutETASeconds := 0.0
+			if payoutRemainingCoins > 0 {
+				if data.stats.Data.CoinsPerMinute > 0 {
+					payoutETASeconds = payoutRemainingCoins / (data.stats.Data.CoinsPerMinute / 60)
+				} else {
+					// Never, since the miner isn't making any income
+					payoutETASeconds = math.Inf(1)
+				}
+			}
+			util.NewGauge(registry, namespace, "miner", "payout_eta_seconds", "Estimated time until the unpaid balance reaches the payout threshold, based on the current income (s).", constLabels).Set(payoutETASeconds)
+		}
+	}
+
+	// Worker stats
+	if data.workers != nil {
+		workerLabels := make(prometheus.Labels)
+		workerLabels["worker"] = ""
+		workerLastSeenMetric := util.NewGaugeVec(registry, namespace, "worker", "last_seen_seconds", "Delta between time of last statistics entry and when the miner was last seen (s).", constLabels, workerLabels)
+		workerReportedHashRateMetric := util.NewGaugeVec(registry, namespace, "worker", "hashrate_reported_hps", "Current hash rate for a worker as reported from the worker (H/s).", constLabels, workerLabels)
+		workerCurrentHashRateMetric := util.NewGaugeVec(registry, namespace, "worker", "hashrate_current_hps", "Current hash rate for a worker (H/s).", constLabels, workerLabels)
+		workerValidSharesMetric := util.NewGaugeVec(registry, namespace, "worker", "shares_valid", "Number of valid shared for a worker.", constLabels, workerLabels)
+		workerInvalidSharesMetric := util.NewGaugeVec(registry, namespace, "worker", "shares_invalid", "Number of invalid shared for a worker.", constLabels, workerLabels)
+		workerStaleSharesMetric := util.NewGaugeVec(registry, namespace, "worker", "shares_stale", "Number of stale shared for a worker.", constLabels, workerLabels)
+		for _, element := range data.workers.Data {
+			labels := make(prometheus.Labels)
+			labels["worker"] = element.Name
+			workerLastSeenMetric.With(labels).Set(element.Timestamp - element.LastSeenTimestamp)
+			workerReportedHashRateMetric.With(labels).Set(element.ReportedHashRate)
+			workerCurrentHashRateMetric.With(labels).Set(element.CurrentHashRate)
+			workerValidSharesMetric.With(labels).Set(element.ValidShares)
+			workerInvalidSharesMetric.With(labels).Set(element.InvalidShares)
+			workerStaleSharesMetric.With(labels).Set(element.StaleShares)
+		}
+	}
+
+	// Worker history stats (optional)
+	// Note: Only the latest history entry is exported for each worker, but with the timestamp from the pool.
+	if data.workerHistory != nil {
+		workerLabels := prometheus.Labels{"worker": ""}
+		workerHistoryReportedHashRateMetric := util.NewTimestampedGaugeVec(registry, namespace, "worker", "history_hashrate_reported_hps", "Hash rate for a worker as reported from the worker, from the latest history entry (H/s).", constLabels, workerLabels)
+		workerHistoryCurrentHashRateMetric := util.NewTimestampedGaugeVec(registry, namespace, "worker", "history_hashrate_current_hps", "Hash rate for a worker, from the latest history entry (H/s).", constLabels, workerLabels)
+		workerHistoryValidSharesMetric := util.NewTimestampedGaugeVec(registry, namespace, "worker", "history_shares_valid", "Number of valid shares for a worker, from the latest history entry.", constLabels, workerLabels)
+		workerHistoryInvalidSharesMetric := util.NewTimestampedGaugeVec(registry, namespace, "worker", "history_shares_invalid", "Number of invalid shares for a worker, from the latest history entry.", constLabels, workerLabels)
+		workerHistoryStaleSharesMetric := util.NewTimestampedGaugeVec(registry, namespace, "worker", "history_shares_stale", "Number of stale shares for a worker, from the latest history entry.", constLabels, workerLabels)
+		for worker, historyData := range data.workerHistory {
+			var lastElement *minerWorkerHistoryAPIDataElement
+			for i, element := range historyData.Data {
+				if lastElement == nil || element.Timestamp > lastElement.Timestamp {
+					lastElement = &historyData.Data[i]
+				}
+			}
+			if lastElement == nil {
+				continue
+			}
+			labels := prometheus.Labels{"worker": worker}
+			timestamp := time.Unix(int64(lastElement.Timestamp), 0)
+			workerHistoryReportedHashRateMetric.Set(labels, lastElement.ReportedHashRate, timestamp)
+			workerHistoryCurrentHashRateMetric.Set(labels, lastElement.CurrentHashRate, timestamp)
+			workerHistoryValidSharesMetric.Set(labels, lastElement.ValidShares, timestamp)
+			workerHistoryInvalidSharesMetric.Set(labels, lastElement.InvalidShares, timestamp)
+			workerHistoryStaleSharesMetric.Set(labels, lastElement.StaleShares, timestamp)
+		}
+	}
+
+	// Payout stats
+	// Note: The API only returns the most recent payouts, so the totals only cover those.
+	if data.payouts != nil {
+		var lastPayoutElement *minerPayoutsAPIDataElement
+		var totalPayoutBaseUnits float64
+		for i, element := range data.payouts.Data {
+			totalPayoutBaseUnits += element.AmountBaseUnits
+			if lastPayoutElement == nil || element.PaidOnTimestamp > lastPayoutElement.PaidOnTimestamp {
+				lastPayoutElement = &data.payouts.Data[i]
+			}
+		}
+		util.NewGauge(registry, namespace, "miner", "payout_count", "Number of payouts to a miner.", constLabels).Set(float64(len(data.payouts.Data)))
+		util.NewGauge(registry, namespace, "miner", "payout_total_coins", "Total amount paid to a miner.", constLabelsWithCurrency).Set(totalPayoutBaseUnits / baseUnitsPerUnit)
+		if lastPayoutElement != nil {
+			util.NewGauge(registry, namespace, "miner", "payout_last_timestamp_seconds", "Time of the last payout to a miner (Unix time).", constLabels).Set(lastPayoutElement.PaidOnTimestamp)
+			util.NewGauge(registry, namespace, "miner", "payout_last_coins", "Amount of the last payout to a miner.", constLabelsWithCurrency).Set(lastPayoutElement.AmountBaseUnits / baseUnitsPerUnit)
+			util.NewGauge(registry, namespace, "miner", "payout_last_info", "Metadata about the last payout to a miner.", util.MergeLabels(constLabels, prometheus.Labels{
+				"tx_hash": lastPayoutElement.TransactionHash,
+			})).Set(1)
+		}
+	}
+
+	// Round stats
+	// Note: The API only returns the most recent rounds, so the window only covers those.
+	if data.rounds != nil {
+		var firstRoundElement, lastRoundElement *minerRoundsAPIDataElement
+		var totalRoundBaseUnits float64
+		for i, element := range data.rounds.Data {
+			totalRoundBaseUnits += element.AmountBaseUnits
+			if firstRoundElement == nil || element.Block < firstRoundElement.Block {
+				firstRoundElement = &data.rounds.Data[i]
+			}
+			if lastRoundElement == nil || element.Block > lastRoundElement.Block {
+				lastRoundElement = &data.rounds.Data[i]
+			}
+		}
+		util.NewGauge(registry, namespace, "miner", "rounds_count", "Number of rounds (blocks) a miner was credited for.", constLabels).Set(float64(len(data.rounds.Data)))
+		util.NewGauge(registry, namespace, "miner", "rounds_credited_coins", "Total amount credited to a miner for the rounds.", constLabelsWithCurrency).Set(totalRoundBaseUnits / baseUnitsPerUnit)
+		if lastRoundElement != nil {
+			util.NewGauge(registry, namespace, "miner", "rounds_window_blocks", "Number of blocks between the first and last round, inclusive.", constLabels).Set(lastRoundElement.Block - firstRoundElement.Block + 1)
+			util.NewGauge(registry, namespace, "miner", "round_last_block", "Block number of the last round a miner was credited for.", constLabels).Set(lastRoundElement.Block)
+			util.NewGauge(registry, namespace, "miner", "round_last_credited_coins", "Amount credited to a miner for the last round.", constLabelsWithCurrency).Set(lastRoundElement.AmountBaseUnits / baseUnitsPerUnit)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"dev.hon.one/prometheus-ethermine-exporter/util"
+)
+
+var pollerCacheHitsMetric = util.NewCounter(exporterRegistry, namespace, "poller", "cache_hits_total", "Number of scrape requests served with data from the poller cache, including stale data from the last successful scrape if the last scrape failed.", nil)
+var pollerCacheMissesMetric = util.NewCounter(exporterRegistry, namespace, "poller", "cache_misses_total", "Number of scrape requests not served with data from the poller cache, because the target was not yet registered, the last scrape failed without stale data to use instead or the request stopped waiting.", nil)
+
+// Periodically scrapes registered targets in the background and caches the latest data,
+// such that scrape requests are served from the cache instead of calling the pool API.
+// Targets are registered when first requested and unregistered when not requested for a while.
+type poller struct {
+	interval time.Duration
+	expiry   time.Duration
+	mutex    sync.Mutex
+	entries  map[string]*pollerEntry
+}
+
+type pollerEntry struct {
+	// Gets the data from the last successful scrape, or nil if none, such that it may fall back to it.
+	scrape func(lastData interface{}) (interface{}, error)
+	// Closed when the first scrape has finished.
+	ready         chan struct{}
+	lastRequested time.Time
+	// Result of the last scrape.
+	data interface{}
+	err  error
+	// Data from the last successful scrape, or nil if none.
+	lastData interface{}
+}
+
+func newPoller(interval time.Duration, expiry time.Duration) *poller {
+	return &poller{
+		interval: interval,
+		expiry:   expiry,
+		entries:  make(map[string]*pollerEntry),
+	}
+}
+
+// Runs the poll loop, never returns.
+func (p *poller) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.poll()
+	}
+}
+
+// Removes expired targets and scrapes the remaining ones.
+// The targets are scraped sequentially to limit the load on the pool API.
+func (p *poller) poll() {
+	now := time.Now()
+	var keys []string
+	var entries []*pollerEntry
+	p.mutex.Lock()
+	for key, entry := range p.entries {
+		if now.Sub(entry.lastRequested) > p.expiry {
+			if enableDebug {
+				fmt.Printf("[DEBUG] Poller: Removing expired target: %s\n", key)
+			}
+			delete(p.entries, key)
+			continue
+		}
+		keys = append(keys, key)
+		entries = append(entries, entry)
+	}
+	p.mutex.Unlock()
+
+	for i, entry := range entries {
+		if enableDebug {
+			fmt.Printf("[DEBUG] Poller: Scraping target: %s\n", keys[i])
+		}
+		p.mutex.Lock()
+		lastData := entry.lastData
+		p.mutex.Unlock()
+		data, err := entry.scrape(lastData)
+		if err != nil && enableDebug {
+			fmt.Printf("[DEBUG] Poller: Failed to scrape target: %s: %v\n", keys[i], err)
+		}
+		p.setResult(entry, data, err)
+	}
+}
+
+// Stores the result of a scrape for the entry.
+func (p *poller) setResult(entry *pollerEntry, data interface{}, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	entry.data = data
+	entry.err = err
+	if err == nil {
+		entry.lastData = data
+	}
+}
+
+// Returns the cached result for the target, registering and scraping it first if it's not already registered.
+// Falling back to the last successful data if the latest scrape failed is left to the scrape function.
+// The first scrape runs in the background, such that it's not cancelled if the context for the request is done.
+func (p *poller) get(ctx context.Context, key string, scrape func(lastData interface{}) (interface{}, error)) (interface{}, error) {
+	p.mutex.Lock()
+	entry, exists := p.entries[key]
+	if exists {
+		entry.lastRequested = time.Now()
+		p.mutex.Unlock()
+	} else {
+		entry = &pollerEntry{
+			scrape:        scrape,
+			ready:         make(chan struct{}),
+			lastRequested: time.Now(),
+		}
+		p.entries[key] = entry
+		p.mutex.Unlock()
+
+		if enableDebug {
+			fmt.Printf("[DEBUG] Poller: Registered new target: %s\n", key)
+		}
+		go func() {
+			data, err := scrape(nil)
+			p.setResult(entry, data, err)
+			close(entry.ready)
+		}()
+	}
+
+	select {
+	case <-entry.ready:
+	case <-ctx.Done():
+		pollerCacheMissesMetric.Inc()
+		return nil, ctx.Err()
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if exists && entry.err == nil {
+		pollerCacheHitsMetric.Inc()
+	} else {
+		pollerCacheMissesMetric.Inc()
+	}
+	return entry.data, entry.err
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPollerFirstScrape(t *testing.T) {
+	p := newPoller(time.Hour, time.Hour)
+	calls := 0
+	scrape := func(lastData interface{}) (interface{}, error) {
+		calls++
+		return calls, nil
+	}
+	hits := testutil.ToFloat64(pollerCacheHitsMetric)
+	misses := testutil.ToFloat64(pollerCacheMissesMetric)
+
+	// The first request waits for the first scrape, the second one uses the cache
+	for i := 0; i < 2; i++ {
+		data, err := p.get(context.Background(), "key", scrape)
+		if data != 1 || err != nil {
+			t.Fatalf("request %d: got %v and %v, want %v and no error", i, data, err, 1)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("got %d scrapes, want 1", calls)
+	}
+	if delta := testutil.ToFloat64(pollerCacheHitsMetric) - hits; delta != 1 {
+		t.Errorf("got %v cache hits, want 1", delta)
+	}
+	if delta := testutil.ToFloat64(pollerCacheMissesMetric) - misses; delta != 1 {
+		t.Errorf("got %v cache misses, want 1", delta)
+	}
+}
+
+func TestPollerPoll(t *testing.T) {
+	p := newPoller(time.Hour, time.Hour)
+	scrapeErr := errors.New("failed")
+	tests := []struct {
+		name         string
+		data         interface{}
+		err          error
+		wantLastData interface{}
+	}{
+		{"first", "a", nil, nil},
+		{"success", "b", nil, "a"},
+		{"failure", nil, scrapeErr, "b"},
+		{"after failure", "c", nil, "b"},
+	}
+	for i, test := range tests {
+		var gotLastData interface{}
+		scrape := func(lastData interface{}) (interface{}, error) {
+			gotLastData = lastData
+			return test.data, test.err
+		}
+		if i == 0 {
+			p.get(context.Background(), "key", scrape)
+		} else {
+			p.entries["key"].scrape = scrape
+			p.poll()
+		}
+		if gotLastData != test.wantLastData {
+			t.Errorf("%s: got last data %v, want %v", test.name, gotLastData, test.wantLastData)
+		}
+		data, err := p.get(context.Background(), "key", scrape)
+		if data != test.data || err != test.err {
+			t.Errorf("%s: got %v and %v, want %v and %v", test.name, data, err, test.data, test.err)
+		}
+	}
+}
+
+func TestPollerExpiry(t *testing.T) {
+	p := newPoller(time.Hour, time.Minute)
+	scrape := func(lastData interface{}) (interface{}, error) {
+		return "data", nil
+	}
+	p.get(context.Background(), "expired", scrape)
+	p.get(context.Background(), "active", scrape)
+	p.entries["expired"].lastRequested = time.Now().Add(-2 * time.Minute)
+	p.poll()
+	if _, exists := p.entries["expired"]; exists {
+		t.Error("expired target still registered")
+	}
+	if _, exists := p.entries["active"]; !exists {
+		t.Error("active target not registered")
+	}
+}
+
+func TestPollerCancelWhileWaiting(t *testing.T) {
+	p := newPoller(time.Hour, time.Hour)
+	release := make(chan struct{})
+	scrape := func(lastData interface{}) (interface{}, error) {
+		<-release
+		return "data", nil
+	}
+
+	// The request stops waiting, but the first scrape continues in the background
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.get(ctx, "key", scrape); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	close(release)
+	data, err := p.get(context.Background(), "key", scrape)
+	if data != "data" || err != nil {
+		t.Errorf("got %v and %v, want %v and no error", data, err, "data")
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"dev.hon.one/prometheus-ethermine-exporter/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const poolBasicAPIURLSuffix = "/poolStats"
+const poolNetworkAPIURLSuffix = "/networkStats"
+const poolServerAPIURLSuffix = "/servers/history"
+const poolBlocksAPIURLSuffix = "/blocks/history"
+
+type poolBasicAPIData struct {
+	baseAPIData
+	Data struct {
+		Stats struct {
+			HashRate      float64 `json:"hashRate"`
+			MinerCount    float64 `json:"miners"`
+			WorkerCount   float64 `json:"workers"`
+			BlocksPerHour float64 `json:"blocksPerHour"`
+		} `json:"poolStats"`
+		TopMiners []struct {
+			Miner    string  `json:"miner"`
+			HashRate float64 `json:"hashRate"`
+		} `json:"topMiners"`
+		MinedBlocks []struct {
+			Number    float64 `json:"number"`
+			Miner     string  `json:"miner"`
+			Timestamp float64 `json:"time"`
+		} `json:"minedBlocks"`
+		Price struct {
+			USD float64 `json:"usd"`
+			BTC float64 `json:"btc"`
+		} `json:"price"`
+	} `json:"data"`
+}
+
+type poolNetworkAPIData struct {
+	baseAPIData
+	Data struct {
+		Timestamp  float64 `json:"time"`
+		BlockTime  float64 `json:"blockTime"`
+		Difficulty float64 `json:"difficulty"`
+		HashRate   float64 `json:"hashrate"`
+		USD        float64 `json:"usd"`
+		BTC        float64 `json:"btc"`
+	} `json:"data"`
+}
+
+type poolBlocksAPIData struct {
+	baseAPIData
+	Data []poolBlocksAPIDataElement `json:"data"`
+}
+
+type poolBlocksAPIDataElement struct {
+	Timestamp  float64 `json:"time"`
+	BlockCount float64 `json:"nbrBlocks"`
+	Difficulty float64 `json:"difficulty"`
+}
+
+type poolServerAPIData struct {
+	baseAPIData
+	Data []poolServerAPIDataElement `json:"data"`
+}
+
+type poolServerAPIDataElement struct {
+	Time     int64   `json:"time"`
+	HashRate float64 `json:"hashrate"`
+	Server   string  `json:"server"`
+}
+
+// All scraped data for a pool.
+type poolData struct {
+	// Time of the oldest data.
+	dataTime time.Time
+	// If any of the data is stale.
+	stale   bool
+	basic   *poolBasicAPIData
+	network *poolNetworkAPIData
+	servers *poolServerAPIData
+	blocks  *poolBlocksAPIData
+	// Results per API endpoint.
+	endpoints []*endpointResult
+}
+
+// Optional data to scrape or export for a pool.
+type poolOptions struct {
+	// Uses the server history which is always scraped.
+	serverHistory bool
+	// Each requires an extra API call.
+	network bool
+	blocks  bool
+}
+
+// Scrapes all data for the pool from the pool API.
+// If only some of the API calls fail, the data for those is left nil and the rest is returned.
+// If all of them fail, the error is returned together with the data containing only the endpoint results.
+func scrapePoolData(ctx context.Context, pool *Pool, options poolOptions) (*poolData, error) {
+	state := newScrapeState(ctx, pool)
+	var data poolData
+	var basicData poolBasicAPIData
+	if err := state.scrapeParse(&basicData, pool.APIURL+poolBasicAPIURLSuffix, "poolStats"); err == nil {
+		data.basic = &basicData
+	}
+	if options.network {
+		var networkData poolNetworkAPIData
+		if err := state.scrapeParse(&networkData, pool.APIURL+poolNetworkAPIURLSuffix, "networkStats"); err == nil {
+			data.network = &networkData
+		}
+	}
+	var serverData poolServerAPIData
+	if err := state.scrapeParse(&serverData, pool.APIURL+poolServerAPIURLSuffix, "servers/history"); err == nil {
+		data.servers = &serverData
+	}
+	if options.blocks {
+		var blocksData poolBlocksAPIData
+		if err := state.scrapeParse(&blocksData, pool.APIURL+poolBlocksAPIURLSuffix, "blocks/history"); err == nil {
+			data.blocks = &blocksData
+		}
+	}
+	data.dataTime = state.dataTime
+	data.stale = state.stale
+	data.endpoints = state.endpoints
+	return &data, state.allFailedError()
+}
+
+// Returns a copy of the data marked as stale, with the endpoint results from a failed scrape.
+func (data *poolData) asStale(endpoints []*endpointResult) *poolData {
+	staleData := *data
+	staleData.stale = true
+	staleData.endpoints = endpoints
+	return &staleData
+}
+
+// Result of scraping a single pool, for scrape requests with multiple pools.
+type poolResult struct {
+	pool    Pool
+	options poolOptions
+	// Only contains the endpoint results if the scrape failed, or nil if the pool API wasn't called.
+	data *poolData
+	err  error
+}
+
+// Builds a new registry for the pool endpoint and adds the scraped data to it.
+// The data may be shared with other requests and must not be modified.
+func buildPoolRegistry(result *poolResult) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	util.NewExporterMetric(registry, namespace, appVersion)
+	addPoolResultMetrics(registry, result)
+
+	return registry
+}
+
+// Builds a new registry with the scrape success metric and the scraped data for all the pools.
+// Contains no exporter metrics, such that it can be combined with other registries.
+func buildPoolResultsRegistry(results []*poolResult) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	for _, result := range results {
+		addPoolResultMetrics(registry, result)
+	}
+	return registry
+}
+
+// Adds the scrape success metric and the scraped data for the pool to the registry.
+// Failed pools only get the scrape success metric and the endpoint metrics.
+func addPoolResultMetrics(registry *prometheus.Registry, result *poolResult) {
+	successValue := 0.0
+	if result.err == nil {
+		successValue = 1
+	}
+	util.NewGauge(registry, namespace, "pool", "scrape_success", "If the pool data was successfully scraped (1) or not (0).", prometheus.Labels{"pool": result.pool.ID}).Set(successValue)
+	if result.err == nil {
+		addPoolMetrics(registry, &result.pool, result.options, result.data)
+	} else if result.data != nil {
+		addEndpointMetrics(registry, getScrapeConstLabels(&result.pool, ""), result.data.endpoints)
+	}
+}
+
+func getPoolConstLabels(pool *Pool) prometheus.Labels {
+	return prometheus.Labels{
+		"pool":      pool.ID,
+		"pool_name": pool.Name,
+	}
+}
+
+// Adds the metrics for the pool to the registry.
+func addPoolMetrics(registry *prometheus.Registry, pool *Pool, options poolOptions, data *poolData) {
+	basicData, networkData, serverData, blocksData := data.basic, data.network, data.servers, data.blocks
+
+	constLabels := getPoolConstLabels(pool)
+
+	// Pool info
+	util.NewGauge(registry, namespace, "pool", "info", "Metadata about the pool.", util.MergeLabels(constLabels, prometheus.Labels{
+		"currency": string(pool.Currency),
+	})).Set(1)
+
+	// Scrape stats
+	scrapeConstLabels := getScrapeConstLabels(pool, "")
+	util.NewGauge(registry, namespace, "scrape", "data_age_seconds", "Time since the oldest data was scraped from the pool API (s).", scrapeConstLabels).Set(time.Since(data.dataTime).Seconds())
+	staleValue := 0.0
+	if data.stale {
+		staleValue = 1
+	}
+	util.NewGauge(registry, namespace, "scrape", "stale", "If any of the data is stale, from the last successful scrape after the pool API failed (1) or not (0).", scrapeConstLabels).Set(staleValue)
+	addEndpointMetrics(registry, scrapeConstLabels, data.endpoints)
+
+	// Basic stats
+	if basicData != nil {
+		util.NewGauge(registry, namespace, "pool", "hashrate_hps", "Current total hash rate of the pool (H/s).", constLabels).Set(basicData.Data.Stats.HashRate)
+		util.NewGauge(registry, namespace, "pool", "miner_count", "Current total number of miners in the pool.", constLabels).Set(basicData.Data.Stats.MinerCount)
+		util.NewGauge(registry, namespace, "pool", "worker_count", "Current total number of workers in the pool.", constLabels).Set(basicData.Data.Stats.WorkerCount)
+		util.NewGauge(registry, namespace, "pool", "price_usd", "Current price (USD).", constLabels).Set(basicData.Data.Price.USD)
+		util.NewGauge(registry, namespace, "pool", "price_btc", "Current price (BTC).", constLabels).Set(basicData.Data.Price.BTC)
+
+		// Top miners
+		topMiners := append(basicData.Data.TopMiners[:0:0], basicData.Data.TopMiners...)
+		sort.SliceStable(topMiners, func(i, j int) bool {
+			return topMiners[i].HashRate > topMiners[j].HashRate
+		})
+		topMinerLabels := make(prometheus.Labels)
+		topMinerLabels["rank"] = ""
+		topMinerLabels["miner"] = ""
+		topMinerHashRateMetric := util.NewGaugeVec(registry, namespace, "pool", "top_miner_hashrate_hps", "Current hash rate of the top miners of the pool (H/s).", constLabels, topMinerLabels)
+		for i, element := range topMiners {
+			if i >= topMinersMaxRank {
+				break
+			}
+			labels := make(prometheus.Labels)
+			labels["rank"] = strconv.Itoa(i + 1)
+			labels["miner"] = element.Miner
+			topMinerHashRateMetric.With(labels).Set(element.HashRate)
+		}
+	}
+
+	// Network stats
+	if networkData != nil {
+		util.NewGauge(registry, namespace, "network", "difficulty", "Current network difficulty.", constLabels).Set(networkData.Data.Difficulty)
+		util.NewGauge(registry, namespace, "network", "hashrate_hps", "Current total hash rate of the network (H/s).", constLabels).Set(networkData.Data.HashRate)
+		util.NewGauge(registry, namespace, "network", "block_time_seconds", "Current average block time of the network (s).", constLabels).Set(networkData.Data.BlockTime)
+		if basicData != nil && networkData.Data.HashRate > 0 {
+			util.NewGauge(registry, namespace, "pool", "network_share_ratio", "Current share of the total network hash rate held by the pool.", constLabels).Set(basicData.Data.Stats.HashRate / networkData.Data.HashRate)
+		}
+	}
+
+	// Server stats
+	if serverData != nil {
+		lastServerElements := make(map[string]*poolServerAPIDataElement)
+		for _, element := range serverData.Data {
+			existingElement, exists := lastServerElements[element.Server]
+			if !exists || element.Time > existingElement.Time {
+				var elementClone poolServerAPIDataElement
+				elementClone = element
+				lastServerElements[element.Server] = &elementClone
+			}
+		}
+		serverLabels := make(prometheus.Labels)
+		serverLabels["server"] = ""
+		serverHashRateMetric := util.NewGaugeVec(registry, namespace, "pool", "server_hashrate_hps", "Current hash rate per server (H/s).", constLabels, serverLabels)
+		serverDataAgeMetric := util.NewGaugeVec(registry, namespace, "pool", "server_data_age_seconds", "Time since the latest history entry per server (s).", constLabels, serverLabels)
+		now := time.Now()
+		for server, element := range lastServerElements {
+			labels := make(prometheus.Labels)
+			labels["server"] = server
+			serverHashRateMetric.With(labels).Set(element.HashRate)
+			serverDataAgeMetric.With(labels).Set(now.Sub(time.Unix(element.Time, 0)).Seconds())
+		}
+
+		// Server history stats (optional)
+		if options.serverHistory {
+			serverHistoryMinHashRateMetric := util.NewGaugeVec(registry, namespace, "pool", "server_history_hashrate_min_hps", "Minimum hash rate per server over the history window (H/s).", constLabels, serverLabels)
+			serverHistoryMaxHashRateMetric := util.NewGaugeVec(registry, namespace, "pool", "server_history_hashrate_max_hps", "Maximum hash rate per server over the history window (H/s).", constLabels, serverLabels)
+			serverHistoryAverageHashRateMetric := util.NewGaugeVec(registry, namespace, "pool", "server_history_hashrate_average_hps", "Average hash rate per server over the history window (H/s).", constLabels, serverLabels)
+			serverHistoryWindowMetric := util.NewGaugeVec(registry, namespace, "pool", "server_history_window_seconds", "Duration between the first and latest history entry per server (s).", constLabels, serverLabels)
+			serverElements := make(map[string][]poolServerAPIDataElement)
+			for _, element := range serverData.Data {
+				serverElements[element.Server] = append(serverElements[element.Server], element)
+			}
+			for server, elements := range serverElements {
+				minHashRate, maxHashRate, totalHashRate := elements[0].HashRate, elements[0].HashRate, 0.0
+				firstTime, lastTime := elements[0].Time, elements[0].Time
+				for _, element := range elements {
+					minHashRate = math.Min(minHashRate, element.HashRate)
+					maxHashRate = math.Max(maxHashRate, element.HashRate)
+					totalHashRate += element.HashRate
+					if element.Time < firstTime {
+						firstTime = element.Time
+					}
+					if element.Time > lastTime {
+						lastTime = element.Time
+					}
+				}
+				labels := make(prometheus.Labels)
+				labels["server"] = server
+				serverHistoryMinHashRateMetric.With(labels).Set(minHashRate)
+				serverHistoryMaxHashRateMetric.With(labels).Set(maxHashRate)
+				serverHistoryAverageHashRateMetric.With(labels).Set(totalHashRate / float64(len(elements)))
+				serverHistoryWindowMetric.With(labels).Set(float64(lastTime - firstTime))
+			}
+		}
+	}
+
+	// Block stats
+	if basicData != nil {
+		util.NewGauge(registry, namespace, "pool", "blocks_per_hour", "Current number of blocks found by the pool per hour.", constLabels).Set(basicData.Data.Stats.BlocksPerHour)
+		lastMinedBlockIndex := -1
+		for i, element := range basicData.Data.MinedBlocks {
+			if lastMinedBlockIndex < 0 || element.Number > basicData.Data.MinedBlocks[lastMinedBlockIndex].Number {
+				lastMinedBlockIndex = i
+			}
+		}
+		if lastMinedBlockIndex >= 0 {
+			util.NewGauge(registry, namespace, "pool", "block_last_number", "Number of the last block found by the pool.", constLabels).Set(basicData.Data.MinedBlocks[lastMinedBlockIndex].Number)
+			util.NewGauge(registry, namespace, "pool", "block_last_timestamp_seconds", "Time of the last block found by the pool (Unix time).", constLabels).Set(basicData.Data.MinedBlocks[lastMinedBlockIndex].Timestamp)
+		}
+	}
+
+	// Block history stats (optional)
+	if blocksData != nil {
+		// The block history consists of evenly spaced entries, so the duration of one entry is the spacing between them.
+		// The expected number of blocks is based on the current pool hash rate and the difficulty for each entry.
+		if len(blocksData.Data) > 1 {
+			firstTimestamp, lastTimestamp := blocksData.Data[0].Timestamp, blocksData.Data[0].Timestamp
+			for _, element := range blocksData.Data {
+				firstTimestamp = math.Min(firstTimestamp, element.Timestamp)
+				lastTimestamp = math.Max(lastTimestamp, element.Timestamp)
+			}
+			entrySeconds := (lastTimestamp - firstTimestamp) / float64(len(blocksData.Data)-1)
+			windowSeconds := entrySeconds * float64(len(blocksData.Data))
+			var blockCount, expectedBlockCount float64
+			for _, element := range blocksData.Data {
+				blockCount += element.BlockCount
+				if basicData != nil && element.Difficulty > 0 {
+					expectedBlockCount += basicData.Data.Stats.HashRate * entrySeconds / element.Difficulty
+				}
+			}
+			util.NewGauge(registry, namespace, "pool", "blocks_window_seconds", "Duration of the block history window (s).", constLabels).Set(windowSeconds)
+			util.NewGauge(registry, namespace, "pool", "blocks_window_count", "Number of blocks found by the pool in the block history window.", constLabels).Set(blockCount)
+			if blockCount > 0 {
+				util.NewGauge(registry, namespace, "pool", "block_interval_average_seconds", "Average time between blocks found by the pool in the block history window (s).", constLabels).Set(windowSeconds / blockCount)
+			}
+			if expectedBlockCount > 0 {
+				util.NewGauge(registry, namespace, "pool", "blocks_luck_ratio", "Number of blocks found by the pool in the block history window relative to the expected number from the pool hash rate and network difficulty (the inverse of the effort).", constLabels).Set(blockCount / expectedBlockCount)
+			}
+		}
+	}
+}
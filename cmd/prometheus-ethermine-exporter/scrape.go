@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"dev.hon.one/prometheus-ethermine-exporter/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type baseAPIData struct {
+	Status string `json:"status"`
+}
+
+type noDataAPIData struct {
+	baseAPIData
+	Data string `json:"data"`
+}
+
+// Scrape error with the HTTP status code to respond with.
+type scrapeError struct {
+	status  int
+	message string
+}
+
+func (err *scrapeError) Error() string {
+	return err.message
+}
+
+// State for scraping all data for a single pool or miner.
+type scrapeState struct {
+	ctx  context.Context
+	pool *Pool
+	// Time of the oldest data, which is older than the scrape if stale data was used.
+	dataTime time.Time
+	// If stale data was used for any of the API calls.
+	stale bool
+	// Results per API endpoint, in call order.
+	endpoints []*endpointResult
+	// If any of the API calls returned data (possibly stale).
+	anyData bool
+	// Error from the first failed API call.
+	firstErr error
+	// If set, the API calls fail with this error without calling the pool API.
+	upstreamErr error
+}
+
+// Result of the calls to a single API endpoint, possibly aggregated over multiple calls.
+type endpointResult struct {
+	endpoint string
+	// If all calls were successful, without using stale data.
+	success  bool
+	duration time.Duration
+	// Number of calls per upstream HTTP status code, or "error" if no response.
+	statusCounts map[string]int
+}
+
+// Parsed data for an API URL, with the status code of the response.
+type coalescedResult struct {
+	data       interface{}
+	statusCode int
+}
+
+// Last successfully parsed data for an API URL.
+type lastGoodDataEntry struct {
+	data interface{}
+	time time.Time
+}
+
+var rateLimitQueuedMetric = util.NewCounterVec(exporterRegistry, namespace, "upstream", "ratelimit_queued_requests_total", "Number of requests to the pool API which were delayed by the rate limiter.", nil, prometheus.Labels{"host": ""})
+var rateLimitRejectedMetric = util.NewCounterVec(exporterRegistry, namespace, "upstream", "ratelimit_rejected_requests_total", "Number of requests to the pool API which were rejected by the rate limiter.", nil, prometheus.Labels{"host": ""})
+var coalescedRequestsMetric = util.NewCounterVec(exporterRegistry, namespace, "upstream", "coalesced_requests_total", "Number of requests to the pool API which were served by an identical concurrent request.", nil, prometheus.Labels{"host": ""})
+var circuitStateMetric = util.NewGaugeVec(exporterRegistry, namespace, "upstream", "circuit_state", "State of the circuit breaker for the pool API (0 = closed, 1 = open, 2 = half-open).", nil, prometheus.Labels{"pool": ""})
+var upstreamRequestsMetric = util.NewCounterVec(exporterRegistry, namespace, "upstream", "requests_total", "Number of requests to the pool API per HTTP status code of the last response (or \"error\" if no response).", nil, prometheus.Labels{"pool": "", "status": ""})
+var upstreamRequestDurationMetric = util.NewHistogramVec(exporterRegistry, namespace, "upstream", "request_duration_seconds", "Duration of requests to the pool API, including retries (s).", nil, prometheus.Labels{"pool": ""}, prometheus.DefBuckets)
+var upstreamParseErrorsMetric = util.NewCounterVec(exporterRegistry, namespace, "upstream", "parse_errors_total", "Number of responses from the pool API which failed to parse.", nil, prometheus.Labels{"pool": ""})
+
+// Rate limiters per pool API host.
+var rateLimiters = make(map[string]*util.RateLimiter)
+var rateLimitersMutex sync.Mutex
+
+// Circuit breakers per pool, if enabled.
+var circuitBreakers = make(map[string]*util.CircuitBreaker)
+var circuitBreakersMutex sync.Mutex
+
+// Coalesces concurrent identical requests to the pool APIs.
+var scrapeRequestGroup util.RequestGroup
+
+// Last successfully parsed data per API URL, if stale data is enabled.
+var lastGoodData = make(map[string]*lastGoodDataEntry)
+var lastGoodDataMutex sync.Mutex
+
+func newScrapeState(ctx context.Context, pool *Pool) *scrapeState {
+	return &scrapeState{
+		ctx:      ctx,
+		pool:     pool,
+		dataTime: time.Now(),
+	}
+}
+
+// Scrape the HTTP target, parse the result and check if the result is OK.
+// If the scrape fails and stale data is enabled, the last successfully parsed data is used instead if not too old.
+// The result is recorded for the endpoint, which is the name of the API endpoint without any parameters.
+func (state *scrapeState) scrapeParse(data interface{}, targetURL string, endpoint string) error {
+	err := state.scrapeParseEndpoint(data, targetURL, endpoint)
+	if err == nil {
+		state.anyData = true
+	} else if state.firstErr == nil {
+		state.firstErr = err
+	}
+	return err
+}
+
+func (state *scrapeState) scrapeParseEndpoint(data interface{}, targetURL string, endpoint string) error {
+	startTime := time.Now()
+	var result interface{}
+	var statusCode int
+	var err error
+	if state.upstreamErr != nil {
+		err = state.upstreamErr
+	} else {
+		result, statusCode, err = scrapeParseCoalesced(state.ctx, data, state.pool, targetURL)
+	}
+	state.recordEndpoint(endpoint, err == nil, time.Since(startTime), statusCode)
+	if err == nil {
+		if staleMaxAge > 0 {
+			storeLastGoodData(targetURL, result)
+		}
+	} else {
+		// Don't use stale data if the API explicitly says there's no data
+		if staleMaxAge <= 0 || isNoDataError(err) {
+			return err
+		}
+		entry := loadLastGoodData(targetURL)
+		if entry == nil {
+			return err
+		}
+		if enableDebug {
+			fmt.Printf("[DEBUG] Using stale data from %s for failed scrape: %s\n", entry.time.Format(time.RFC3339), targetURL)
+		}
+		result = entry.data
+		state.stale = true
+		if entry.time.Before(state.dataTime) {
+			state.dataTime = entry.time
+		}
+	}
+	// Note: Shallow copy, any slices and maps are shared with other callers.
+	reflect.ValueOf(data).Elem().Set(reflect.ValueOf(result).Elem())
+	return nil
+}
+
+// Records the result of a call to the endpoint, aggregating multiple calls to the same endpoint.
+func (state *scrapeState) recordEndpoint(endpoint string, success bool, duration time.Duration, statusCode int) {
+	var result *endpointResult
+	for _, existingResult := range state.endpoints {
+		if existingResult.endpoint == endpoint {
+			result = existingResult
+			break
+		}
+	}
+	if result == nil {
+		result = &endpointResult{endpoint: endpoint, success: true, statusCounts: make(map[string]int)}
+		state.endpoints = append(state.endpoints, result)
+	}
+	result.success = result.success && success
+	result.duration += duration
+	result.statusCounts[getStatusLabel(statusCode)]++
+}
+
+// Returns the status code as a label value, or "error" if there was no response.
+func getStatusLabel(statusCode int) string {
+	if statusCode == 0 {
+		return "error"
+	}
+	return strconv.Itoa(statusCode)
+}
+
+// Returns the error from the first failed API call if all API calls failed, or nil if any data was scraped.
+func (state *scrapeState) allFailedError() error {
+	if state.anyData {
+		return nil
+	}
+	return state.firstErr
+}
+
+// Returns true if the error is from the pool API saying there's no data, e.g. for an unknown miner.
+func isNoDataError(err error) bool {
+	var scrapeErr *scrapeError
+	return errors.As(err, &scrapeErr) && scrapeErr.status == 404
+}
+
+// Returns true if the data from the last successful poll may be used after the poll failed with the error,
+// like for the individual API calls if stale data is enabled.
+func canUsePolledStaleData(dataTime time.Time, err error) bool {
+	if staleMaxAge <= 0 || isClientError(err) {
+		return false
+	}
+	return time.Since(dataTime) <= staleMaxAge
+}
+
+// Returns true if the error is caused by the request, e.g. an unknown miner, instead of a failing pool API.
+func isClientError(err error) bool {
+	var scrapeErr *scrapeError
+	return errors.As(err, &scrapeErr) && scrapeErr.status >= 400 && scrapeErr.status < 500
+}
+
+// Returns the const labels for the scrape metrics, which are shared by pools and miners and need the same label names to be combined in the static endpoint.
+// The miner address is empty for pools.
+func getScrapeConstLabels(pool *Pool, minerAddress string) prometheus.Labels {
+	return prometheus.Labels{
+		"pool":      pool.ID,
+		"pool_name": pool.Name,
+		"miner":     minerAddress,
+	}
+}
+
+// Adds the scrape success, duration and upstream status metrics per API endpoint to the registry.
+func addEndpointMetrics(registry *prometheus.Registry, constLabels prometheus.Labels, endpoints []*endpointResult) {
+	endpointLabels := prometheus.Labels{"endpoint": ""}
+	endpointStatusLabels := prometheus.Labels{"endpoint": "", "status": ""}
+	successMetric := util.NewGaugeVec(registry, namespace, "scrape", "success", "If the last call to the pool API endpoint was successful (1) or not (0), including if stale data was used instead.", constLabels, endpointLabels)
+	durationMetric := util.NewGaugeVec(registry, namespace, "scrape", "duration_seconds", "Duration of the last call to the pool API endpoint (s).", constLabels, endpointLabels)
+	statusMetric := util.NewGaugeVec(registry, namespace, "upstream", "status", "Number of calls to the pool API endpoint per HTTP status code (or \"error\" if no response) for the last scrape.", constLabels, endpointStatusLabels)
+	for _, result := range endpoints {
+		successValue := 0.0
+		if result.success {
+			successValue = 1
+		}
+		successMetric.With(prometheus.Labels{"endpoint": result.endpoint}).Set(successValue)
+		durationMetric.With(prometheus.Labels{"endpoint": result.endpoint}).Set(result.duration.Seconds())
+		for status, count := range result.statusCounts {
+			statusMetric.With(prometheus.Labels{"endpoint": result.endpoint, "status": status}).Set(float64(count))
+		}
+	}
+}
+
+// Stores the data as the last good data for the URL and removes any entries which have become too old to use.
+func storeLastGoodData(targetURL string, data interface{}) {
+	now := time.Now()
+	lastGoodDataMutex.Lock()
+	defer lastGoodDataMutex.Unlock()
+	for entryURL, entry := range lastGoodData {
+		if now.Sub(entry.time) > staleMaxAge {
+			delete(lastGoodData, entryURL)
+		}
+	}
+	lastGoodData[targetURL] = &lastGoodDataEntry{data, now}
+}
+
+// Returns the last good data for the URL, or nil if none or too old.
+func loadLastGoodData(targetURL string) *lastGoodDataEntry {
+	lastGoodDataMutex.Lock()
+	defer lastGoodDataMutex.Unlock()
+	entry, exists := lastGoodData[targetURL]
+	if !exists || time.Since(entry.time) > staleMaxAge {
+		return nil
+	}
+	return entry
+}
+
+// Get the host part of the API URL of the pool.
+func getAPIHost(pool *Pool) string {
+	if apiURL, err := url.Parse(pool.APIURL); err == nil {
+		return apiURL.Host
+	}
+	return pool.APIURL
+}
+
+// Rate limit for an API host, shared by all pools using it.
+type hostRateLimit struct {
+	ratePerSecond float64
+	burst         int
+}
+
+// Get the rate limit for each API host, using the lowest rate and burst of the pools using it.
+func getHostRateLimits(pools map[string]Pool) map[string]hostRateLimit {
+	limits := make(map[string]hostRateLimit)
+	for _, pool := range pools {
+		host := getAPIHost(&pool)
+		limit := hostRateLimit{pool.RateLimitPerMinute / 60, pool.RateLimitBurst}
+		if existingLimit, exists := limits[host]; exists {
+			limit.ratePerSecond = math.Min(limit.ratePerSecond, existingLimit.ratePerSecond)
+			if existingLimit.burst < limit.burst {
+				limit.burst = existingLimit.burst
+			}
+		}
+		limits[host] = limit
+	}
+	return limits
+}
+
+// Get the rate limiter for the API host of the pool, creating it if it doesn't exist yet.
+func getRateLimiter(pool *Pool) *util.RateLimiter {
+	host := getAPIHost(pool)
+	rateLimitersMutex.Lock()
+	defer rateLimitersMutex.Unlock()
+	rateLimiter, exists := rateLimiters[host]
+	if !exists {
+		limit, ok := getActiveConfig().hostRateLimits[host]
+		if !ok {
+			limit = hostRateLimit{pool.RateLimitPerMinute / 60, pool.RateLimitBurst}
+		}
+		labels := prometheus.Labels{"host": host}
+		rateLimiter = util.NewRateLimiter(limit.ratePerSecond, limit.burst, rateLimitMaxWait, rateLimitQueuedMetric.With(labels), rateLimitRejectedMetric.With(labels))
+		rateLimiters[host] = rateLimiter
+	}
+	return rateLimiter
+}
+
+// Update the existing rate limiters with the rate limits for their API hosts.
+func updateRateLimiters(limits map[string]hostRateLimit) {
+	rateLimitersMutex.Lock()
+	defer rateLimitersMutex.Unlock()
+	for host, limit := range limits {
+		if rateLimiter, exists := rateLimiters[host]; exists {
+			rateLimiter.SetRate(limit.ratePerSecond, limit.burst)
+		}
+	}
+}
+
+// Get the circuit breaker for the pool, creating it if it doesn't exist yet. Returns nil if circuit breakers are disabled.
+func getCircuitBreaker(pool *Pool) *util.CircuitBreaker {
+	if circuitFailureThreshold <= 0 {
+		return nil
+	}
+	circuitBreakersMutex.Lock()
+	defer circuitBreakersMutex.Unlock()
+	circuitBreaker, exists := circuitBreakers[pool.ID]
+	if !exists {
+		circuitBreaker = util.NewCircuitBreaker(circuitFailureThreshold, circuitOpenDuration, circuitStateMetric.With(prometheus.Labels{"pool": pool.ID}))
+		circuitBreakers[pool.ID] = circuitBreaker
+	}
+	return circuitBreaker
+}
+
+// Scrape the HTTP target through the circuit breaker for the pool, if enabled.
+// Rate limited and cancelled requests and responses caused by the request don't count as failures.
+func scrapeHTTPTarget(ctx context.Context, pool *Pool, targetURL string) ([]byte, int, error) {
+	circuitBreaker := getCircuitBreaker(pool)
+	if circuitBreaker == nil {
+		return sendHTTPRequest(ctx, pool, targetURL)
+	}
+	if err := circuitBreaker.Allow(); err != nil {
+		if enableDebug {
+			fmt.Printf("[DEBUG] Circuit breaker open for pool %s, skipping scrape request: %s\n", pool.ID, targetURL)
+		}
+		return nil, 0, err
+	}
+	rawData, statusCode, err := sendHTTPRequest(ctx, pool, targetURL)
+	switch {
+	case err == nil:
+		circuitBreaker.Success()
+	case errors.Is(err, util.ErrRateLimited) || errors.Is(err, context.Canceled) || !isUpstreamFailure(err):
+		circuitBreaker.Release()
+	default:
+		circuitBreaker.Failure()
+	}
+	return rawData, statusCode, err
+}
+
+// Returns true if the error from the HTTP request is a failure of the pool API, i.e. a network error or a 429 or 5xx response.
+// Other 4xx responses are caused by the request, e.g. a mistyped miner address.
+func isUpstreamFailure(err error) bool {
+	var statusErr *util.HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+	}
+	return true
+}
+
+// Send the request to the HTTP target, with retries, and update the upstream request metrics.
+// Requests rejected by the rate limiter without any response are not counted.
+func sendHTTPRequest(ctx context.Context, pool *Pool, targetURL string) ([]byte, int, error) {
+	startTime := time.Now()
+	rawData, statusCode, err := util.ScrapeHTTPTarget(ctx, getActiveConfig().httpClient, targetURL, getRateLimiter(pool), enableDebug)
+	if errors.Is(err, util.ErrRateLimited) && statusCode == 0 {
+		return rawData, statusCode, err
+	}
+	upstreamRequestDurationMetric.With(prometheus.Labels{"pool": pool.ID}).Observe(time.Since(startTime).Seconds())
+	upstreamRequestsMetric.With(prometheus.Labels{"pool": pool.ID, "status": getStatusLabel(statusCode)}).Inc()
+	return rawData, statusCode, err
+}
+
+// Scrape and parse the HTTP target, sharing the request and parsed result with concurrent calls for the same target.
+// Returns a new pointer of the same type as the provided data, which must not be modified, and the status code of the response (0 if none).
+func scrapeParseCoalesced(ctx context.Context, data interface{}, pool *Pool, targetURL string) (interface{}, int, error) {
+	value, shared, err := scrapeRequestGroup.Do(ctx, targetURL, func(groupCtx context.Context) (interface{}, error) {
+		// Detached from the context of the caller that started it, since other callers may be waiting for it, but cancelled when no callers are left
+		scrapeCtx, cancel := context.WithTimeout(groupCtx, getActiveConfig().httpClient.MaxDuration(rateLimitMaxWait))
+		defer cancel()
+		newData := reflect.New(reflect.TypeOf(data).Elem()).Interface()
+		statusCode, err := scrapeParseUncoalesced(scrapeCtx, newData, pool, targetURL)
+		if err != nil {
+			return &coalescedResult{nil, statusCode}, err
+		}
+		return &coalescedResult{newData, statusCode}, nil
+	})
+	if shared {
+		if enableDebug {
+			fmt.Printf("[DEBUG] Coalesced scrape request: %s\n", targetURL)
+		}
+		coalescedRequestsMetric.With(prometheus.Labels{"host": getAPIHost(pool)}).Inc()
+	}
+	if value == nil {
+		// Stopped waiting
+		return nil, 0, err
+	}
+	result := value.(*coalescedResult)
+	return result.data, result.statusCode, err
+}
+
+func scrapeParseUncoalesced(ctx context.Context, data interface{}, pool *Pool, targetURL string) (int, error) {
+	// Scrape
+	rawData, statusCode, err := scrapeHTTPTarget(ctx, pool, targetURL)
+	if errors.Is(err, util.ErrRateLimited) {
+		return statusCode, &scrapeError{503, "Rate limit exceeded for pool API."}
+	}
+	if errors.Is(err, util.ErrCircuitOpen) {
+		return statusCode, &scrapeError{503, "Circuit breaker open for pool API."}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return statusCode, &scrapeError{504, "Timed out while scraping target."}
+	}
+	if err != nil {
+		return statusCode, &scrapeError{500, fmt.Sprintf("Failed to scrape target: %s", err)}
+	}
+
+	// Check status
+	var baseData baseAPIData
+	if err := util.ParseJSON(&baseData, rawData, enableDebug); err != nil {
+		upstreamParseErrorsMetric.With(prometheus.Labels{"pool": pool.ID}).Inc()
+		return statusCode, &scrapeError{500, "Failed to parse scraped data."}
+	}
+	if baseData.Status != "OK" {
+		return statusCode, &scrapeError{500, "API data not OK."}
+	}
+
+	// Check if no data (ignore failed parse)
+	var noDataData noDataAPIData
+	if err := util.ParseJSON(&noDataData, rawData, false); err == nil {
+		if noDataData.Data == "NO DATA" {
+			return statusCode, &scrapeError{404, "API data not found for pool."}
+		}
+	}
+
+	// Parse final data
+	if err := util.ParseJSON(data, rawData, enableDebug); err != nil {
+		upstreamParseErrorsMetric.With(prometheus.Labels{"pool": pool.ID}).Inc()
+		return statusCode, &scrapeError{500, "Failed to parse scraped data."}
+	}
+	return statusCode, nil
+}
+
+// Write the error to the response, with the status code from the scrape error if any.
+func writeScrapeError(response http.ResponseWriter, err error) {
+	status := 500
+	var scrapeErr *scrapeError
+	if errors.As(err, &scrapeErr) {
+		status = scrapeErr.status
+	}
+	http.Error(response, fmt.Sprintf("%d - %s\n", status, err), status)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"dev.hon.one/prometheus-ethermine-exporter/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestIsUpstreamFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"network error", errors.New("connection refused"), true},
+		{"too many requests", &util.HTTPStatusError{StatusCode: 429}, true},
+		{"server error", &util.HTTPStatusError{StatusCode: 503}, true},
+		{"wrapped server error", fmt.Errorf("scrape: %w", &util.HTTPStatusError{StatusCode: 500}), true},
+		{"bad request", &util.HTTPStatusError{StatusCode: 400}, false},
+		{"not found", &util.HTTPStatusError{StatusCode: 404}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isUpstreamFailure(test.err); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestScrapeMetricLabels(t *testing.T) {
+	// Failed results only get the scrape metrics, which are shared by pools and miners in the static endpoint
+	pool := Pool{ID: "ethermine", Name: "Ethermine"}
+	endpoints := []*endpointResult{{endpoint: "test", statusCounts: map[string]int{"503": 1}}}
+	err := &scrapeError{503, "Failed."}
+	poolRegistry := buildPoolResultsRegistry([]*poolResult{{pool: pool, data: &poolData{endpoints: endpoints}, err: err}})
+	minerRegistry := buildMinerRegistry([]*minerResult{{pool: pool, minerAddress: "abc", data: &minerData{endpoints: endpoints}, err: err}})
+
+	families, gatherErr := prometheus.Gatherers{minerRegistry, poolRegistry}.Gather()
+	if gatherErr != nil {
+		t.Fatal(gatherErr)
+	}
+	checkedCount := 0
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), namespace+"_scrape_") && !strings.HasPrefix(family.GetName(), namespace+"_upstream_") {
+			continue
+		}
+		checkedCount++
+		if len(family.GetMetric()) != 2 {
+			t.Errorf("%s: got %d metrics, want one for the pool and one for the miner", family.GetName(), len(family.GetMetric()))
+		}
+		var firstLabelNames string
+		for i, metric := range family.GetMetric() {
+			var labelNames []string
+			for _, label := range metric.GetLabel() {
+				labelNames = append(labelNames, label.GetName())
+			}
+			sort.Strings(labelNames)
+			if i == 0 {
+				firstLabelNames = strings.Join(labelNames, ",")
+			} else if strings.Join(labelNames, ",") != firstLabelNames {
+				t.Errorf("%s: got labels %v and %v", family.GetName(), firstLabelNames, labelNames)
+			}
+		}
+	}
+	if checkedCount != 3 {
+		t.Errorf("got %d scrape metrics, want 3", checkedCount)
+	}
+}
@@ -0,0 +1,108 @@
+package util
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrCircuitOpen - Returned when a request is not allowed because the circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitState - State of a circuit breaker, with the value used for the state metric.
+type CircuitState int
+
+// Circuit breaker states.
+const (
+	CircuitClosed   CircuitState = 0
+	CircuitOpen     CircuitState = 1
+	CircuitHalfOpen CircuitState = 2
+)
+
+// CircuitBreaker - Opens after a number of consecutive failures, rejecting requests until the open duration has passed.
+// Then a single probe request is allowed (half-open), which closes the circuit if successful and opens it again if not.
+type CircuitBreaker struct {
+	mutex            sync.Mutex
+	failureThreshold int
+	openDuration     time.Duration
+	state            CircuitState
+	failures         int
+	openedTime       time.Time
+	probing          bool
+	stateGauge       prometheus.Gauge
+}
+
+// NewCircuitBreaker - Creates a new closed circuit breaker. The gauge is optional and is set to the current state.
+func NewCircuitBreaker(failureThreshold int, openDuration time.Duration, stateGauge prometheus.Gauge) *CircuitBreaker {
+	breaker := &CircuitBreaker{
+		failureThreshold: failureThreshold,
+		openDuration:     openDuration,
+		stateGauge:       stateGauge,
+	}
+	breaker.setState(CircuitClosed)
+	return breaker
+}
+
+// Allow - Returns ErrCircuitOpen if the request is not allowed. Otherwise the outcome must be reported using Success, Failure or Release.
+func (breaker *CircuitBreaker) Allow() error {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	if breaker.state == CircuitOpen && time.Since(breaker.openedTime) >= breaker.openDuration {
+		breaker.setState(CircuitHalfOpen)
+	}
+	switch breaker.state {
+	case CircuitOpen:
+		return ErrCircuitOpen
+	case CircuitHalfOpen:
+		// Only allow one probe at a time
+		if breaker.probing {
+			return ErrCircuitOpen
+		}
+		breaker.probing = true
+	}
+	return nil
+}
+
+// Success - Reports that an allowed request succeeded, closing the circuit.
+func (breaker *CircuitBreaker) Success() {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.probing = false
+	breaker.failures = 0
+	breaker.setState(CircuitClosed)
+}
+
+// Failure - Reports that an allowed request failed, opening the circuit if the probe failed or too many consecutive requests failed.
+func (breaker *CircuitBreaker) Failure() {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.probing = false
+	breaker.failures++
+	if breaker.state == CircuitHalfOpen || breaker.failures >= breaker.failureThreshold {
+		breaker.openedTime = time.Now()
+		breaker.setState(CircuitOpen)
+	}
+}
+
+// Release - Reports that an allowed request finished without a success or failure outcome, e.g. if it was cancelled.
+func (breaker *CircuitBreaker) Release() {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.probing = false
+}
+
+// State - Returns the current state.
+func (breaker *CircuitBreaker) State() CircuitState {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	return breaker.state
+}
+
+func (breaker *CircuitBreaker) setState(state CircuitState) {
+	breaker.state = state
+	if breaker.stateGauge != nil {
+		breaker.stateGauge.Set(float64(state))
+	}
+}
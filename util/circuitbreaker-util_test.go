@@ -0,0 +1,55 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	// Steps: "allow" and "reject" expect Allow to succeed or fail, the rest report the outcome.
+	tests := []struct {
+		name         string
+		openDuration time.Duration
+		steps        []string
+		wantState    CircuitState
+	}{
+		{"closed below threshold", time.Hour, []string{"allow", "failure", "allow", "failure"}, CircuitClosed},
+		{"opens at threshold", time.Hour, []string{"allow", "failure", "allow", "failure", "allow", "failure", "reject"}, CircuitOpen},
+		{"success resets failures", time.Hour, []string{"allow", "failure", "allow", "failure", "allow", "success", "allow", "failure"}, CircuitClosed},
+		{"half-open after open duration", 0, []string{"allow", "failure", "allow", "failure", "allow", "failure", "allow"}, CircuitHalfOpen},
+		{"one probe at a time", 0, []string{"allow", "failure", "allow", "failure", "allow", "failure", "allow", "reject"}, CircuitHalfOpen},
+		{"successful probe closes", 0, []string{"allow", "failure", "allow", "failure", "allow", "failure", "allow", "success", "allow", "allow"}, CircuitClosed},
+		{"failed probe opens", time.Hour, []string{"allow", "failure", "allow", "failure", "allow", "failure", "half-open", "allow", "failure", "reject"}, CircuitOpen},
+		{"released probe allows another", 0, []string{"allow", "failure", "allow", "failure", "allow", "failure", "allow", "release", "allow"}, CircuitHalfOpen},
+		{"release keeps failures", time.Hour, []string{"allow", "failure", "allow", "failure", "allow", "release", "allow", "failure", "reject"}, CircuitOpen},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			breaker := NewCircuitBreaker(3, test.openDuration, nil)
+			for i, step := range test.steps {
+				switch step {
+				case "allow":
+					if err := breaker.Allow(); err != nil {
+						t.Fatalf("step %d: got %v, want allowed", i, err)
+					}
+				case "reject":
+					if err := breaker.Allow(); err != ErrCircuitOpen {
+						t.Fatalf("step %d: got %v, want %v", i, err, ErrCircuitOpen)
+					}
+				case "success":
+					breaker.Success()
+				case "failure":
+					breaker.Failure()
+				case "release":
+					breaker.Release()
+				case "half-open":
+					// Pretend the open duration has passed
+					breaker.openedTime = time.Now().Add(-test.openDuration)
+				}
+			}
+			if state := breaker.State(); state != test.wantState {
+				t.Errorf("got state %v, want %v", state, test.wantState)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package util
+
+import (
+	"context"
+	"sync"
+)
+
+// RequestGroup - Coalesces concurrent calls with the same key, such that the function is only executed once and the result is shared.
+type RequestGroup struct {
+	mutex sync.Mutex
+	calls map[string]*requestGroupCall
+}
+
+type requestGroupCall struct {
+	done   chan struct{}
+	cancel context.CancelFunc
+	// Number of callers still waiting for the result.
+	waiters int
+	value   interface{}
+	err     error
+}
+
+// Do - Executes the function, or waits for and returns the result of an in-flight call with the same key.
+// The function runs in the background with a context which is only cancelled when all callers have stopped waiting,
+// such that it's not aborted if just the caller that started it stops waiting. The function should limit its own duration.
+// If the context is done before the result is ready, the context error is returned.
+// The returned bool is true if the result came from another call.
+func (group *RequestGroup) Do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	group.mutex.Lock()
+	if group.calls == nil {
+		group.calls = make(map[string]*requestGroupCall)
+	}
+	call, shared := group.calls[key]
+	if !shared {
+		callCtx, cancel := context.WithCancel(context.Background())
+		call = &requestGroupCall{done: make(chan struct{}), cancel: cancel}
+		group.calls[key] = call
+		go func() {
+			value, err := fn(callCtx)
+			group.mutex.Lock()
+			call.value, call.err = value, err
+			group.removeCall(key, call)
+			group.mutex.Unlock()
+			cancel()
+			close(call.done)
+		}()
+	}
+	call.waiters++
+	group.mutex.Unlock()
+
+	select {
+	case <-call.done:
+		return call.value, shared, call.err
+	case <-ctx.Done():
+		group.mutex.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// Abandoned, so any new callers start a new call
+			group.removeCall(key, call)
+			call.cancel()
+		}
+		group.mutex.Unlock()
+		return nil, shared, ctx.Err()
+	}
+}
+
+// Removes the call for the key, unless it has already been replaced by a new call. Must be called with the mutex locked.
+func (group *RequestGroup) removeCall(key string, call *requestGroupCall) {
+	if group.calls[key] == call {
+		delete(group.calls, key)
+	}
+}
@@ -0,0 +1,165 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRequestGroupSharedResult(t *testing.T) {
+	var group RequestGroup
+	release := make(chan struct{})
+	var calls int
+	var callsMutex sync.Mutex
+	fn := func(ctx context.Context) (interface{}, error) {
+		callsMutex.Lock()
+		calls++
+		callsMutex.Unlock()
+		<-release
+		return "value", nil
+	}
+
+	const callerCount = 5
+	type result struct {
+		value  interface{}
+		shared bool
+		err    error
+	}
+	results := make(chan result, callerCount)
+	for i := 0; i < callerCount; i++ {
+		go func() {
+			value, shared, err := group.Do(context.Background(), "key", fn)
+			results <- result{value, shared, err}
+		}()
+	}
+	waitForWaiters(t, &group, "key", callerCount)
+	close(release)
+
+	sharedCount := 0
+	for i := 0; i < callerCount; i++ {
+		result := <-results
+		if result.value != "value" || result.err != nil {
+			t.Errorf("got %v and %v, want %v and no error", result.value, result.err, "value")
+		}
+		if result.shared {
+			sharedCount++
+		}
+	}
+	if calls != 1 {
+		t.Errorf("got %d calls, want 1", calls)
+	}
+	if sharedCount != callerCount-1 {
+		t.Errorf("got %d shared results, want %d", sharedCount, callerCount-1)
+	}
+	if len(group.calls) != 0 {
+		t.Errorf("got %d calls left in the group, want 0", len(group.calls))
+	}
+}
+
+func TestRequestGroupCallerLeavingEarly(t *testing.T) {
+	var group RequestGroup
+	release := make(chan struct{})
+	fnCtxErr := make(chan error, 1)
+	fn := func(ctx context.Context) (interface{}, error) {
+		<-release
+		fnCtxErr <- ctx.Err()
+		return "value", nil
+	}
+
+	// The first caller starts the call and leaves before it's done
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	firstDone := make(chan error, 1)
+	go func() {
+		_, _, err := group.Do(firstCtx, "key", fn)
+		firstDone <- err
+	}()
+	waitForWaiters(t, &group, "key", 1)
+	secondDone := make(chan interface{}, 1)
+	go func() {
+		value, _, _ := group.Do(context.Background(), "key", fn)
+		secondDone <- value
+	}()
+	waitForWaiters(t, &group, "key", 2)
+	cancelFirst()
+	if err := <-firstDone; !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v for the first caller, want %v", err, context.Canceled)
+	}
+
+	// The second caller still gets the result
+	close(release)
+	if value := <-secondDone; value != "value" {
+		t.Errorf("got %v for the second caller, want %v", value, "value")
+	}
+	if err := <-fnCtxErr; err != nil {
+		t.Errorf("got %v for the function context, want it not cancelled", err)
+	}
+}
+
+func TestRequestGroupAllCallersLeaving(t *testing.T) {
+	var group RequestGroup
+	fnCtxErr := make(chan error, 1)
+	fn := func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		fnCtxErr <- ctx.Err()
+		return nil, ctx.Err()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := group.Do(ctx, "key", fn)
+		done <- err
+	}()
+	waitForWaiters(t, &group, "key", 1)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+
+	// The function is cancelled and the key is removed, such that new callers start a new call
+	select {
+	case err := <-fnCtxErr:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v for the function context, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("function context not cancelled")
+	}
+	value, shared, err := group.Do(context.Background(), "key", func(ctx context.Context) (interface{}, error) {
+		return "new", nil
+	})
+	if value != "new" || shared || err != nil {
+		t.Errorf("got %v, %v and %v, want a new unshared call", value, shared, err)
+	}
+}
+
+func TestRequestGroupDoneContext(t *testing.T) {
+	var group RequestGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	called := false
+	_, _, err := group.Do(ctx, "key", func(ctx context.Context) (interface{}, error) {
+		called = true
+		return nil, nil
+	})
+	if !errors.Is(err, context.Canceled) || called {
+		t.Errorf("got %v and called %v, want %v and not called", err, called, context.Canceled)
+	}
+}
+
+// Waits until the number of callers waiting for the call with the key is reached.
+func waitForWaiters(t *testing.T, group *RequestGroup, key string, waiters int) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		group.mutex.Lock()
+		call, exists := group.calls[key]
+		reached := exists && call.waiters >= waiters
+		group.mutex.Unlock()
+		if reached {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d waiters", waiters)
+}
@@ -3,69 +3,25 @@ package util
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-// ScrapeHTTPTarget - Scrapes the HTTP target and returns the data.
-// Returns nil if not successful. Any errors are written to the response writer.
-func ScrapeHTTPTarget(response http.ResponseWriter, targetURL string, debug bool) []byte {
-	// Scrape
-	if debug {
-		fmt.Printf("[DEBUG] Sending scrape request: %s\n", targetURL)
-	}
-	scrapeRequest, scrapeRequestErr := http.NewRequest("GET", targetURL, nil)
-	if scrapeRequestErr != nil {
-		if debug {
-			fmt.Printf("[DEBUG] Failed to make request to scrape target:\n%v\n", scrapeRequestErr)
-		}
-		message := fmt.Sprintf("500 - Failed to scrape target: %s\n", scrapeRequestErr)
-		http.Error(response, message, 500)
-		return nil
-	}
-	scrapeRequest.Header.Set("Accept", "application/json")
-	scrapeClient := http.Client{}
-	scrapeResponse, scrapeResponseErr := scrapeClient.Do(scrapeRequest)
-	if scrapeResponseErr != nil {
-		if debug {
-			fmt.Printf("[DEBUG] Failed to scrape target:\n%v\n", scrapeResponseErr)
-		}
-		message := fmt.Sprintf("500 - Failed to scrape target: %s\n", scrapeResponseErr)
-		http.Error(response, message, 500)
-		return nil
-	}
-	defer scrapeResponse.Body.Close()
-	rawData, rawDataErr := ioutil.ReadAll(scrapeResponse.Body)
-	if rawDataErr != nil {
-		if debug {
-			fmt.Printf("[DEBUG] Failed to read data from target:\n%v\n", rawDataErr)
-		}
-		message := fmt.Sprintf("500 - Failed to scrape target: %s\n", rawDataErr)
-		http.Error(response, message, 500)
-		return nil
-	}
-
-	return rawData
-}
-
 // ParseJSON - Parses the data to JSON.
-// Returns true if successful. Any errors are written to the response writer.
-func ParseJSON(data interface{}, response http.ResponseWriter, rawData []byte, failSilently bool, debug bool) bool {
-	if err := json.Unmarshal(rawData, &data); err != nil {
-		if !failSilently {
-			if debug {
-				fmt.Printf("[DEBUG] Failed to unmarshal data from target:\n%v\n", err)
-				fmt.Printf("[DEBUG] Raw data:\n%s\n", rawData)
-			}
-			message := fmt.Sprintf("500 - Failed to parse scraped data.\n")
-			http.Error(response, message, 500)
+func ParseJSON(data interface{}, rawData []byte, debug bool) error {
+	if err := json.Unmarshal(rawData, data); err != nil {
+		if debug {
+			fmt.Printf("[DEBUG] Failed to unmarshal data from target:\n%v\n", err)
+			fmt.Printf("[DEBUG] Raw data:\n%s\n", rawData)
 		}
-		return false
+		return err
 	}
 
-	return true
+	return nil
 }
 
 // NewExporterMetric - Convenience function to create, register and set a gauge containing exporter info.
@@ -101,6 +57,46 @@ func NewGaugeVec(registry *prometheus.Registry, namespace string, subsystem stri
 	return metric
 }
 
+// NewCounterVec - Convenience function to create, register and return a labeled counter.
+func NewCounterVec(registry *prometheus.Registry, namespace string, subsystem string, name string, help string, constLabels prometheus.Labels, labels prometheus.Labels) *prometheus.CounterVec {
+	var metric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        name,
+		Help:        help,
+		ConstLabels: constLabels,
+	}, MapKeys(labels))
+	registry.MustRegister(metric)
+	return metric
+}
+
+// NewCounter - Convenience function to create, register and return a counter.
+func NewCounter(registry *prometheus.Registry, namespace string, subsystem string, name string, help string, constLabels prometheus.Labels) prometheus.Counter {
+	var metric = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        name,
+		Help:        help,
+		ConstLabels: constLabels,
+	})
+	registry.MustRegister(metric)
+	return metric
+}
+
+// NewHistogramVec - Convenience function to create, register and return a labeled histogram.
+func NewHistogramVec(registry *prometheus.Registry, namespace string, subsystem string, name string, help string, constLabels prometheus.Labels, labels prometheus.Labels, buckets []float64) *prometheus.HistogramVec {
+	var metric = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        name,
+		Help:        help,
+		ConstLabels: constLabels,
+		Buckets:     buckets,
+	}, MapKeys(labels))
+	registry.MustRegister(metric)
+	return metric
+}
+
 // MergeLabels - Merge multiple label maps into one. If they have overlapping keys, the value from the most right map will be used.
 func MergeLabels(maps ...prometheus.Labels) prometheus.Labels {
 	result := make(prometheus.Labels)
@@ -111,3 +107,50 @@ func MergeLabels(maps ...prometheus.Labels) prometheus.Labels {
 	}
 	return result
 }
+
+// TimestampedGaugeVec - A labeled gauge where each sample carries its own timestamp, e.g. the time of the scraped data point.
+type TimestampedGaugeVec struct {
+	desc       *prometheus.Desc
+	labelNames []string
+	mutex      sync.Mutex
+	metrics    map[string]prometheus.Metric
+}
+
+// NewTimestampedGaugeVec - Convenience function to create, register and return a labeled gauge with explicit sample timestamps.
+func NewTimestampedGaugeVec(registry *prometheus.Registry, namespace string, subsystem string, name string, help string, constLabels prometheus.Labels, labels prometheus.Labels) *TimestampedGaugeVec {
+	labelNames := MapKeys(labels)
+	sort.Strings(labelNames)
+	metric := &TimestampedGaugeVec{
+		desc:       prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, name), help, labelNames, constLabels),
+		labelNames: labelNames,
+		metrics:    make(map[string]prometheus.Metric),
+	}
+	registry.MustRegister(metric)
+	return metric
+}
+
+// Set - Set the value and timestamp of the sample with the provided labels, replacing any existing sample with the same labels.
+func (vec *TimestampedGaugeVec) Set(labels prometheus.Labels, value float64, timestamp time.Time) {
+	labelValues := make([]string, len(vec.labelNames))
+	for i, labelName := range vec.labelNames {
+		labelValues[i] = labels[labelName]
+	}
+	metric := prometheus.NewMetricWithTimestamp(timestamp, prometheus.MustNewConstMetric(vec.desc, prometheus.GaugeValue, value, labelValues...))
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	vec.metrics[strings.Join(labelValues, "\xff")] = metric
+}
+
+// Describe - Implements prometheus.Collector.
+func (vec *TimestampedGaugeVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- vec.desc
+}
+
+// Collect - Implements prometheus.Collector.
+func (vec *TimestampedGaugeVec) Collect(ch chan<- prometheus.Metric) {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	for _, metric := range vec.metrics {
+		ch <- metric
+	}
+}
@@ -0,0 +1,278 @@
+package util
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// HTTPClientOptions - Options for HTTPClient.
+type HTTPClientOptions struct {
+	// Timeout for establishing connections.
+	ConnectTimeout time.Duration
+	// Timeout for each request attempt, including reading the body.
+	Timeout time.Duration
+	// Max number of retries after the first attempt fails.
+	MaxRetries int
+	// Backoff before the first retry, doubled for every subsequent retry and randomized by ±50%.
+	BackoffInitial time.Duration
+	// Max backoff between retries, before randomization.
+	BackoffMax time.Duration
+	// HTTP, HTTPS or SOCKS5 proxy URL, optionally with credentials. The proxy environment variables are used if empty.
+	ProxyURL string
+	// PEM file with extra CA certificates to trust in addition to the system ones, if not empty.
+	CAFile string
+	// PEM files with the client certificate and key, if not empty.
+	CertFile string
+	KeyFile  string
+	// Min TLS version ("1.0", "1.1", "1.2" or "1.3"), or the Go default if empty.
+	TLSMinVersion string
+}
+
+// HTTPClient - Shared HTTP client with timeouts and retries with backoff.
+type HTTPClient struct {
+	client  *http.Client
+	options HTTPClientOptions
+}
+
+// MaxDuration - Returns the max time ScrapeHTTPTarget may take with this client, given the max time the rate limiter may wait for each attempt.
+func (client *HTTPClient) MaxDuration(rateLimitMaxWait time.Duration) time.Duration {
+	options := client.options
+	attempts := time.Duration(options.MaxRetries + 1)
+	// The backoff is randomized up to 150%
+	return attempts*(rateLimitMaxWait+options.Timeout) + time.Duration(options.MaxRetries)*options.BackoffMax*3/2
+}
+
+// HTTPStatusError - Returned when the target responds with a non-2xx status code.
+type HTTPStatusError struct {
+	StatusCode int
+	// Zero if not provided by the target.
+	RetryAfter time.Duration
+}
+
+func (err *HTTPStatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status: %d %s", err.StatusCode, http.StatusText(err.StatusCode))
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewHTTPClient - Creates a new HTTP client, or returns an error if the proxy or TLS options are invalid.
+func NewHTTPClient(options HTTPClientOptions) (*HTTPClient, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   options.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+
+	// Proxy
+	if options.ProxyURL != "" {
+		proxyURL, err := url.Parse(options.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported proxy URL scheme: %s", proxyURL.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	// TLS
+	tlsConfig, err := newTLSConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	return &HTTPClient{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   options.Timeout,
+		},
+		options: options,
+	}, nil
+}
+
+func newTLSConfig(options HTTPClientOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if options.TLSMinVersion != "" {
+		version, ok := tlsVersions[options.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported min TLS version: %s", options.TLSMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	if options.CAFile != "" {
+		caData, err := ioutil.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil || rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no valid certificates found in CA file: %s", options.CAFile)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	if options.CertFile != "" || options.KeyFile != "" {
+		if options.CertFile == "" || options.KeyFile == "" {
+			return nil, errors.New("both the client certificate file and key file must be provided")
+		}
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// ScrapeHTTPTarget - Scrapes the HTTP target and returns the data and the status code of the last response (0 if none).
+// Retries on network errors and 429 and 5xx responses, respecting any Retry-After header, until the context is done.
+// Gives up if the Retry-After header asks to wait longer than the max backoff.
+// The rate limiter is optional and applies to each attempt.
+func ScrapeHTTPTarget(ctx context.Context, client *HTTPClient, targetURL string, rateLimiter *RateLimiter, debug bool) ([]byte, int, error) {
+	statusCode := 0
+	for attempt := 0; ; attempt++ {
+		// Wait for rate limiter
+		if rateLimiter != nil {
+			if err := rateLimiter.Wait(ctx); err != nil {
+				if debug {
+					fmt.Printf("[DEBUG] Rate limited scrape request: %s\n", targetURL)
+				}
+				return nil, statusCode, err
+			}
+		}
+
+		// Scrape
+		rawData, attemptStatusCode, err := client.scrapeOnce(ctx, targetURL, debug)
+		if attemptStatusCode != 0 {
+			statusCode = attemptStatusCode
+		}
+		if err == nil {
+			return rawData, statusCode, nil
+		}
+		if attempt >= client.options.MaxRetries || !isRetryableError(ctx, err) {
+			return nil, statusCode, err
+		}
+
+		// Wait before retrying, unless that would exceed the deadline
+		delay := client.backoff(attempt)
+		var statusErr *HTTPStatusError
+		if errors.As(err, &statusErr) && statusErr.RetryAfter > delay {
+			if statusErr.RetryAfter > client.options.BackoffMax {
+				if debug {
+					fmt.Printf("[DEBUG] Not retrying scrape request, Retry-After %s exceeds the max backoff: %s\n", statusErr.RetryAfter, targetURL)
+				}
+				return nil, statusCode, err
+			}
+			delay = statusErr.RetryAfter
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return nil, statusCode, err
+		}
+		if debug {
+			fmt.Printf("[DEBUG] Retrying scrape request in %s: %s\n", delay, targetURL)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, statusCode, err
+		case <-timer.C:
+		}
+	}
+}
+
+func (client *HTTPClient) scrapeOnce(ctx context.Context, targetURL string, debug bool) ([]byte, int, error) {
+	if debug {
+		fmt.Printf("[DEBUG] Sending scrape request: %s\n", targetURL)
+	}
+	scrapeRequest, scrapeRequestErr := http.NewRequestWithContext(ctx, "GET", targetURL, nil)
+	if scrapeRequestErr != nil {
+		if debug {
+			fmt.Printf("[DEBUG] Failed to make request to scrape target:\n%v\n", scrapeRequestErr)
+		}
+		return nil, 0, scrapeRequestErr
+	}
+	scrapeRequest.Header.Set("Accept", "application/json")
+	scrapeResponse, scrapeResponseErr := client.client.Do(scrapeRequest)
+	if scrapeResponseErr != nil {
+		if debug {
+			fmt.Printf("[DEBUG] Failed to scrape target:\n%v\n", scrapeResponseErr)
+		}
+		return nil, 0, scrapeResponseErr
+	}
+	defer scrapeResponse.Body.Close()
+	rawData, rawDataErr := ioutil.ReadAll(scrapeResponse.Body)
+	if rawDataErr != nil {
+		if debug {
+			fmt.Printf("[DEBUG] Failed to read data from target:\n%v\n", rawDataErr)
+		}
+		return nil, scrapeResponse.StatusCode, rawDataErr
+	}
+	if scrapeResponse.StatusCode < 200 || scrapeResponse.StatusCode >= 300 {
+		statusErr := &HTTPStatusError{
+			StatusCode: scrapeResponse.StatusCode,
+			RetryAfter: parseRetryAfter(scrapeResponse.Header.Get("Retry-After")),
+		}
+		if debug {
+			fmt.Printf("[DEBUG] Failed to scrape target:\n%v\n", statusErr)
+		}
+		return nil, scrapeResponse.StatusCode, statusErr
+	}
+
+	return rawData, scrapeResponse.StatusCode, nil
+}
+
+// Returns the randomized backoff before the retry after the provided attempt.
+func (client *HTTPClient) backoff(attempt int) time.Duration {
+	backoff := math.Min(float64(client.options.BackoffInitial)*math.Pow(2, float64(attempt)), float64(client.options.BackoffMax))
+	return time.Duration(backoff * (0.5 + rand.Float64()))
+}
+
+// Network errors and 429 and 5xx responses are retryable, unless the context is done.
+func isRetryableError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+	}
+	return true
+}
+
+// Parses the Retry-After header value, either in seconds or as an HTTP date. Returns zero if empty or invalid.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
@@ -0,0 +1,98 @@
+package util
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	client := &HTTPClient{options: HTTPClientOptions{BackoffInitial: time.Second, BackoffMax: 10 * time.Second}}
+	tests := []struct {
+		attempt     int
+		wantBackoff time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{3, 8 * time.Second},
+		{4, 10 * time.Second},
+		{20, 10 * time.Second},
+	}
+	for _, test := range tests {
+		// Randomized by ±50%
+		minBackoff := test.wantBackoff / 2
+		maxBackoff := test.wantBackoff * 3 / 2
+		for i := 0; i < 100; i++ {
+			if backoff := client.backoff(test.attempt); backoff < minBackoff || backoff > maxBackoff {
+				t.Fatalf("attempt %d: got %v, want between %v and %v", test.attempt, backoff, minBackoff, maxBackoff)
+			}
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		// Lower bound, since the time until a date keeps decreasing
+		wantMin time.Duration
+		wantMax time.Duration
+	}{
+		{"empty", "", 0, 0},
+		{"seconds", "120", 120 * time.Second, 120 * time.Second},
+		{"zero seconds", "0", 0, 0},
+		{"negative seconds", "-5", 0, 0},
+		{"invalid", "soon", 0, 0},
+		{"future date", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 58 * time.Second, time.Minute},
+		{"past date", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if delay := parseRetryAfter(test.value); delay < test.wantMin || delay > test.wantMax {
+				t.Errorf("got %v, want between %v and %v", delay, test.wantMin, test.wantMax)
+			}
+		})
+	}
+}
+
+func TestScrapeHTTPTargetRetryAfter(t *testing.T) {
+	tests := []struct {
+		name         string
+		retryAfter   string
+		wantAttempts int32
+	}{
+		{"shorter than max backoff", "1", 2},
+		{"longer than max backoff", "60", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var attempts int32
+			server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				atomic.AddInt32(&attempts, 1)
+				response.Header().Set("Retry-After", test.retryAfter)
+				response.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			defer server.Close()
+			client, err := NewHTTPClient(HTTPClientOptions{
+				Timeout:        time.Second,
+				MaxRetries:     1,
+				BackoffInitial: time.Millisecond,
+				BackoffMax:     10 * time.Second,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, statusCode, err := ScrapeHTTPTarget(context.Background(), client, server.URL, nil, false)
+			if err == nil || statusCode != http.StatusServiceUnavailable {
+				t.Errorf("got status %d and error %v, want status %d and an error", statusCode, err, http.StatusServiceUnavailable)
+			}
+			if attempts := atomic.LoadInt32(&attempts); attempts != test.wantAttempts {
+				t.Errorf("got %d attempts, want %d", attempts, test.wantAttempts)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrRateLimited - Returned when a request would have to wait too long for the rate limiter.
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// RateLimiter - Token bucket rate limiter which queues requests for up to a max wait time and rejects them after that.
+type RateLimiter struct {
+	mutex           sync.Mutex
+	ratePerSecond   float64
+	burst           float64
+	maxWait         time.Duration
+	tokens          float64
+	lastUpdate      time.Time
+	queuedCounter   prometheus.Counter
+	rejectedCounter prometheus.Counter
+}
+
+// NewRateLimiter - Creates a new rate limiter with a full bucket. The counters are optional.
+func NewRateLimiter(ratePerSecond float64, burst int, maxWait time.Duration, queuedCounter prometheus.Counter, rejectedCounter prometheus.Counter) *RateLimiter {
+	return &RateLimiter{
+		ratePerSecond:   ratePerSecond,
+		burst:           float64(burst),
+		maxWait:         maxWait,
+		tokens:          float64(burst),
+		lastUpdate:      time.Now(),
+		queuedCounter:   queuedCounter,
+		rejectedCounter: rejectedCounter,
+	}
+}
+
+// Wait - Waits until the request is allowed, or returns ErrRateLimited immediately if that would take longer than the max wait time or the context deadline.
+// If the context is done while waiting, the token is given back.
+func (limiter *RateLimiter) Wait(ctx context.Context) error {
+	maxWait := limiter.maxWait
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < maxWait {
+		maxWait = time.Until(deadline)
+	}
+	delay, ok := limiter.reserve(maxWait)
+	if !ok {
+		if limiter.rejectedCounter != nil {
+			limiter.rejectedCounter.Inc()
+		}
+		return ErrRateLimited
+	}
+	if delay > 0 {
+		if limiter.queuedCounter != nil {
+			limiter.queuedCounter.Inc()
+		}
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			limiter.refund()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil
+}
+
+// SetRate - Changes the rate and burst, keeping the current tokens up to the new burst.
+func (limiter *RateLimiter) SetRate(ratePerSecond float64, burst int) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.refill(time.Now())
+	limiter.ratePerSecond = ratePerSecond
+	limiter.burst = float64(burst)
+	limiter.tokens = math.Min(limiter.burst, limiter.tokens)
+}
+
+// Available - Returns how many requests may currently be made without any of them being rejected for having to wait longer than the max wait time.
+func (limiter *RateLimiter) Available() int {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.refill(time.Now())
+	available := math.Floor(limiter.tokens + limiter.ratePerSecond*limiter.maxWait.Seconds())
+	return int(math.Max(0, available))
+}
+
+// Takes a token (possibly going into debt) and returns how long to wait before it's available.
+func (limiter *RateLimiter) reserve(maxWait time.Duration) (time.Duration, bool) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.refill(time.Now())
+	if limiter.tokens >= 1 {
+		limiter.tokens--
+		return 0, true
+	}
+	if limiter.ratePerSecond <= 0 {
+		return 0, false
+	}
+	delay := time.Duration((1 - limiter.tokens) / limiter.ratePerSecond * float64(time.Second))
+	if delay > maxWait {
+		return 0, false
+	}
+	limiter.tokens--
+	return delay, true
+}
+
+// Gives back a token taken by a request which was not made.
+func (limiter *RateLimiter) refund() {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.refill(time.Now())
+	limiter.tokens = math.Min(limiter.burst, limiter.tokens+1)
+}
+
+// Adds the tokens gained since the last update. Must be called with the mutex locked.
+func (limiter *RateLimiter) refill(now time.Time) {
+	limiter.tokens = math.Min(limiter.burst, limiter.tokens+now.Sub(limiter.lastUpdate).Seconds()*limiter.ratePerSecond)
+	limiter.lastUpdate = now
+}
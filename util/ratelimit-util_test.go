@@ -0,0 +1,137 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRefill(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name       string
+		tokens     float64
+		elapsed    time.Duration
+		wantTokens float64
+	}{
+		{"no time passed", 1, 0, 1},
+		{"partial refill", 0, 500 * time.Millisecond, 1},
+		{"refill capped at burst", 1, time.Minute, 5},
+		{"paying off debt", -3, time.Second, -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := NewRateLimiter(2, 5, time.Second, nil, nil)
+			limiter.tokens = test.tokens
+			limiter.lastUpdate = start
+			limiter.refill(start.Add(test.elapsed))
+			if limiter.tokens != test.wantTokens {
+				t.Errorf("got %v tokens, want %v", limiter.tokens, test.wantTokens)
+			}
+		})
+	}
+}
+
+func TestRateLimiterReserve(t *testing.T) {
+	tests := []struct {
+		name       string
+		tokens     float64
+		maxWait    time.Duration
+		wantDelay  time.Duration
+		wantOK     bool
+		wantTokens float64
+	}{
+		{"token available", 2, time.Second, 0, true, 1},
+		{"going into debt", 0, 2 * time.Second, time.Second, true, -1},
+		{"deeper debt", -1, 2 * time.Second, 2 * time.Second, true, -2},
+		{"waiting too long", -2, 2 * time.Second, 0, false, -2},
+		{"no waiting allowed", 0, 0, 0, false, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Slow enough for the refill during the test to be negligible
+			limiter := NewRateLimiter(1, 5, test.maxWait, nil, nil)
+			limiter.tokens = test.tokens
+			delay, ok := limiter.reserve(test.maxWait)
+			if ok != test.wantOK {
+				t.Fatalf("got ok %v, want %v", ok, test.wantOK)
+			}
+			if diff := delay - test.wantDelay; diff < -10*time.Millisecond || diff > 0 {
+				t.Errorf("got delay %v, want %v", delay, test.wantDelay)
+			}
+			if diff := limiter.tokens - test.wantTokens; diff < 0 || diff > 0.01 {
+				t.Errorf("got %v tokens, want %v", limiter.tokens, test.wantTokens)
+			}
+		})
+	}
+}
+
+func TestRateLimiterAvailable(t *testing.T) {
+	tests := []struct {
+		name          string
+		tokens        float64
+		maxWait       time.Duration
+		wantAvailable int
+	}{
+		{"full bucket", 5, 0, 5},
+		{"full bucket with waiting", 5, 3 * time.Second, 8},
+		{"in debt", -2, 3 * time.Second, 1},
+		{"deep debt", -10, 3 * time.Second, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := NewRateLimiter(1, 5, test.maxWait, nil, nil)
+			limiter.tokens = test.tokens
+			if available := limiter.Available(); available != test.wantAvailable {
+				t.Errorf("got %v available, want %v", available, test.wantAvailable)
+			}
+		})
+	}
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	tests := []struct {
+		name       string
+		tokens     float64
+		rate       float64
+		burst      int
+		wantTokens float64
+	}{
+		{"lower burst caps tokens", 8, 1, 5, 5},
+		{"higher burst keeps tokens", 8, 1, 20, 8},
+		{"debt is kept", -2, 1, 5, -2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// No refill, to keep the tokens exact
+			limiter := NewRateLimiter(0, 10, time.Second, nil, nil)
+			limiter.tokens = test.tokens
+			limiter.SetRate(test.rate, test.burst)
+			if limiter.ratePerSecond != test.rate || limiter.burst != float64(test.burst) {
+				t.Errorf("got rate %v and burst %v, want %v and %v", limiter.ratePerSecond, limiter.burst, test.rate, test.burst)
+			}
+			if limiter.tokens != test.wantTokens {
+				t.Errorf("got %v tokens, want %v", limiter.tokens, test.wantTokens)
+			}
+		})
+	}
+}
+
+func TestRateLimiterWaitCancelled(t *testing.T) {
+	// Slow enough for the refill during the test to be negligible
+	limiter := NewRateLimiter(0.1, 1, time.Minute, nil, nil)
+	if err := limiter.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Queued behind the first request until cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := limiter.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if limiter.tokens < 0 || limiter.tokens > 0.01 {
+		t.Errorf("got %v tokens after the cancelled request, want the token given back", limiter.tokens)
+	}
+}